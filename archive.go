@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ArchiveDirName is the directory in dbDir for the archive of deleted log records
+const ArchiveDirName = "archive"
+
+const archiveFilePrefix = "log-records-"
+const archiveFileSuffix = ".jsonl.gz"
+
+// ArchivedLogRecord is a LogRecords row as it's stored in the archive, one JSON object per line
+type ArchivedLogRecord struct {
+	Id int64 `db:"Id"`
+	Ts int64 `db:"Ts"`
+	LogLineData
+	LogLineType string `db:"LogLineType"`
+	LogTime     int64  `db:"LogTime"`
+	LogTimeUs   int64  `db:"LogTimeUs"`
+	Fingerprint string `db:"Fingerprint"`
+}
+
+// ToLogLineData restores the parsed record for inserting it into a DB, the fingerprint is kept,
+// so a day restored twice isn't stored twice
+func (t ArchivedLogRecord) ToLogLineData() *LogLineData {
+	res := t.LogLineData
+	res.Fingerprint = t.Fingerprint
+	res.LogLineType, _ = LogLineTypeFromString(t.LogLineType)
+	if t.LogTimeUs != 0 {
+		res.LogTime = time.UnixMicro(t.LogTimeUs).UTC()
+	} else {
+		res.LogTime = time.Unix(t.LogTime, 0).UTC()
+	}
+	return &res
+}
+
+// archiveFileName returns the file of the records of the UTC day of the log time like log-records-2024-06-18.jsonl.gz
+func archiveFileName(logTime int64) string {
+	return archiveFilePrefix + time.Unix(logTime, 0).UTC().Format(time.DateOnly) + archiveFileSuffix
+}
+
+// archiveLogRecords appends the records to the files of their days.
+// Every call adds a gzip member to the files, readers handle such files as one stream.
+func archiveLogRecords(archiveDir string, items []ArchivedLogRecord) error {
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return errors.Join(errors.New("unable to create archive dir"), err)
+	}
+
+	var fileNames []string
+	itemsByFile := make(map[string][]ArchivedLogRecord)
+	for _, item := range items {
+		fileName := archiveFileName(item.LogTime)
+		if _, ok := itemsByFile[fileName]; !ok {
+			fileNames = append(fileNames, fileName)
+		}
+		itemsByFile[fileName] = append(itemsByFile[fileName], item)
+	}
+
+	for _, fileName := range fileNames {
+		if err := appendArchiveFile(path.Join(archiveDir, fileName), itemsByFile[fileName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendArchiveFile(filePath string, items []ArchivedLogRecord) error {
+	fp, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to open archive file %s", filePath), err)
+	}
+	defer CloseOrWarn(fp)
+
+	gzWriter := gzip.NewWriter(fp)
+	encoder := json.NewEncoder(gzWriter)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return errors.Join(fmt.Errorf("unable to write archive file %s", filePath), err)
+		}
+	}
+	if err := gzWriter.Close(); err != nil {
+		return errors.Join(fmt.Errorf("unable to write archive file %s", filePath), err)
+	}
+
+	// The records are deleted from the DB after that
+	if err := fp.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("unable to sync archive file %s", filePath), err)
+	}
+	return nil
+}
+
+// ListArchiveFiles returns the archive files of the days from fromDate to toDate like 2024-06-18 in order,
+// empty dates don't limit the range
+func ListArchiveFiles(archiveDir string, fromDate string, toDate string) ([]string, error) {
+	filePaths, err := filepath.Glob(path.Join(archiveDir, archiveFilePrefix+"*"+archiveFileSuffix))
+	if err != nil {
+		return nil, errors.Join(errors.New("unable to list archive files"), err)
+	}
+
+	var res []string
+	for _, filePath := range filePaths {
+		date := strings.TrimSuffix(strings.TrimPrefix(path.Base(filePath), archiveFilePrefix), archiveFileSuffix)
+		if (fromDate == "" || date >= fromDate) && (toDate == "" || date <= toDate) {
+			res = append(res, filePath)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// ReadArchiveFile calls handler for every record of the archive file
+func ReadArchiveFile(filePath string, handler func(item *ArchivedLogRecord) error) error {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to open archive file %s", filePath), err)
+	}
+	defer CloseOrWarn(fp)
+
+	gzReader, err := gzip.NewReader(bufio.NewReader(fp))
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to read gzip %s", filePath), err)
+	}
+
+	decoder := json.NewDecoder(gzReader)
+	for {
+		var item ArchivedLogRecord
+		err := decoder.Decode(&item)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errors.Join(fmt.Errorf("unable to read archive file %s", filePath), err)
+		}
+
+		if err := handler(&item); err != nil {
+			return err
+		}
+	}
+}
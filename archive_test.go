@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveLogRecords(t *testing.T) {
+	dbDir := t.TempDir()
+	db := Must1(NewLogDb(dbDir))
+	defer db.Close()
+
+	items := []*LogLineData{
+		Must1(ParseLogLine(readFileToString("test/data/log-line-request.txt"))),
+		Must1(ParseLogLine(readFileToString("test/data/log-line-request-error.txt"))),
+	}
+	items[1].LogTime = items[1].LogTime.Add(48 * time.Hour)
+	Must1(db.InsertLogRecords(items))
+	Must1(db.logDb.Exec(`UPDATE LogRecords SET Ts = 0`))
+
+	archiveDir := path.Join(dbDir, ArchiveDirName)
+	assert.Equal(t, int64(2), Must1(db.LogRecordsVacuumClean(RetentionParams{MaxAge: time.Hour, ArchiveDir: archiveDir})))
+	assert.Equal(t, int64(0), Must1(db.LogRecordsVacuumClean(RetentionParams{MaxAge: time.Hour, ArchiveDir: archiveDir})))
+
+	filePaths := Must1(ListArchiveFiles(archiveDir, "", ""))
+	assert.Equal(t, []string{
+		path.Join(archiveDir, "log-records-"+items[0].LogTime.UTC().Format(time.DateOnly)+".jsonl.gz"),
+		path.Join(archiveDir, "log-records-"+items[1].LogTime.UTC().Format(time.DateOnly)+".jsonl.gz"),
+	}, filePaths)
+	assert.Len(t, Must1(ListArchiveFiles(archiveDir, items[1].LogTime.UTC().Format(time.DateOnly), "")), 1)
+
+	var restored []*LogLineData
+	for _, filePath := range filePaths {
+		Must0(ReadArchiveFile(filePath, func(item *ArchivedLogRecord) error {
+			restored = append(restored, item.ToLogLineData())
+			return nil
+		}))
+	}
+	assert.Len(t, restored, 2)
+	for i := range items {
+		items[i].LogTime = items[i].LogTime.UTC()
+		assert.Equal(t, items[i], restored[i])
+	}
+
+	scratchDb := Must1(NewLogDb(t.TempDir()))
+	defer scratchDb.Close()
+	assert.Equal(t, 0, Must1(scratchDb.InsertLogRecords(restored)))
+	assert.Len(t, Must1(scratchDb.GetUsersReportData(0, nil)), 1)
+}
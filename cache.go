@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxMemoryCacheItems is the max number of cache items kept in memory in front of cacheDb
+const MaxMemoryCacheItems = 10000
+
+// CacheNamespace groups cache items of one kind, like resolved domains, with their TTLs
+type CacheNamespace struct {
+	Name string
+	// Ttl is the lifetime of the found values
+	Ttl time.Duration
+	// NegativeTtl is the lifetime of the values the getter didn't find, so they are retried earlier
+	NegativeTtl time.Duration
+}
+
+// CacheStats counts cache lookups of a namespace since the start
+type CacheStats struct {
+	Namespace  string
+	MemoryHits int64
+	DiskHits   int64
+	Misses     int64
+	Errors     int64
+}
+
+func (t CacheStats) HitRate() float64 {
+	lookups := t.MemoryHits + t.DiskHits + t.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(t.MemoryHits+t.DiskHits) * 100 / float64(lookups)
+}
+
+type cacheItem struct {
+	Value     string `db:"Value"`
+	ExpiresTs int64  `db:"ExpiresTs"`
+}
+
+// GetCached returns the value from the memory front or from cacheDb, the getter is called when both miss.
+// The getter returns whether the value is found, not found values are kept for NegativeTtl of the namespace.
+func (t *LogDb) GetCached(namespace CacheNamespace, key string, getter func() (string, bool, error)) (string, error) {
+	cacheKey := namespace.Name + ":" + key
+	now := time.Now().Unix()
+
+	if item, ok := t.getMemoryCacheItem(cacheKey, now); ok {
+		t.countCacheLookup(namespace.Name, func(stats *CacheStats) { stats.MemoryHits++ })
+		return item.Value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	var item cacheItem
+	err := t.cacheDb.GetContext(ctx, &item, `SELECT Value, ExpiresTs FROM CacheData WHERE Key == ? AND ExpiresTs > ?`, cacheKey, now)
+	if err == nil {
+		t.setMemoryCacheItem(cacheKey, item)
+		t.countCacheLookup(namespace.Name, func(stats *CacheStats) { stats.DiskHits++ })
+		return item.Value, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		t.countCacheLookup(namespace.Name, func(stats *CacheStats) { stats.Errors++ })
+		return "", errors.Join(errors.New("unable to get CacheData item"), err)
+	}
+
+	value, found, err := getter()
+	if err != nil {
+		t.countCacheLookup(namespace.Name, func(stats *CacheStats) { stats.Errors++ })
+		return "", errors.Join(errors.New("unable to get new value"), err)
+	}
+	t.countCacheLookup(namespace.Name, func(stats *CacheStats) { stats.Misses++ })
+
+	ttl := namespace.Ttl
+	if !found {
+		ttl = namespace.NegativeTtl
+	}
+	item = cacheItem{Value: value, ExpiresTs: now + int64(ttl/time.Second)}
+	t.setMemoryCacheItem(cacheKey, item)
+
+	_, err = t.cacheDb.ExecContext(
+		ctx,
+		`REPLACE INTO CacheData (Key, Namespace, Value, Negative, ExpiresTs) VALUES (?, ?, ?, ?, ?)`,
+		cacheKey,
+		namespace.Name,
+		value,
+		!found,
+		item.ExpiresTs,
+	)
+	if err != nil {
+		return "", errors.Join(errors.New("unable to set new value to DB"), err)
+	}
+	return value, nil
+}
+
+func (t *LogDb) getMemoryCacheItem(cacheKey string, now int64) (cacheItem, bool) {
+	t.cacheLock.Lock()
+	defer t.cacheLock.Unlock()
+
+	item, ok := t.cacheItems[cacheKey]
+	if ok && item.ExpiresTs <= now {
+		delete(t.cacheItems, cacheKey)
+		return item, false
+	}
+	return item, ok
+}
+
+func (t *LogDb) setMemoryCacheItem(cacheKey string, item cacheItem) {
+	t.cacheLock.Lock()
+	defer t.cacheLock.Unlock()
+
+	if len(t.cacheItems) >= MaxMemoryCacheItems {
+		t.cleanMemoryCache(time.Now().Unix(), MaxMemoryCacheItems-1)
+	}
+	t.cacheItems[cacheKey] = item
+}
+
+// cleanMemoryCache deletes expired items and then arbitrary ones above maxItems, cacheDb still has them
+func (t *LogDb) cleanMemoryCache(now int64, maxItems int) int {
+	deleted := 0
+	for cacheKey, item := range t.cacheItems {
+		if item.ExpiresTs <= now {
+			delete(t.cacheItems, cacheKey)
+			deleted++
+		}
+	}
+	for cacheKey := range t.cacheItems {
+		if len(t.cacheItems) <= maxItems {
+			break
+		}
+		delete(t.cacheItems, cacheKey)
+		deleted++
+	}
+	return deleted
+}
+
+func (t *LogDb) countCacheLookup(namespace string, count func(stats *CacheStats)) {
+	t.cacheLock.Lock()
+	defer t.cacheLock.Unlock()
+
+	stats, ok := t.cacheStats[namespace]
+	if !ok {
+		stats = &CacheStats{Namespace: namespace}
+		t.cacheStats[namespace] = stats
+	}
+	count(stats)
+}
+
+// CacheStats returns lookup counts of the cache namespaces ordered by name
+func (t *LogDb) CacheStats() []CacheStats {
+	t.cacheLock.Lock()
+	defer t.cacheLock.Unlock()
+
+	var res []CacheStats
+	for _, stats := range t.cacheStats {
+		res = append(res, *stats)
+	}
+	slices.SortFunc(res, func(a, b CacheStats) int {
+		return strings.Compare(a.Namespace, b.Namespace)
+	})
+	return res
+}
+
+// CacheDataVacuumClean deletes expired items and the items that expire first above maxItems
+func (t *LogDb) CacheDataVacuumClean(maxItems int) (int64, error) {
+	log.Tracef("Executing CacheDataVacuumClean(%d)", maxItems)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	t.cacheLock.Lock()
+	t.cleanMemoryCache(now, MaxMemoryCacheItems)
+	t.cacheLock.Unlock()
+
+	res, err := t.cacheDb.ExecContext(
+		ctx,
+		`
+		DELETE FROM
+		   CacheData
+	   	WHERE
+	   	    ExpiresTs <= ?
+			OR Key IN (
+				SELECT
+					Key
+				FROM
+					CacheData
+				ORDER BY
+	   				ExpiresTs DESC
+	   			LIMIT
+	   				-1
+	   			OFFSET
+	   				?
+			)
+		`,
+		now,
+		maxItems,
+	)
+	if err != nil {
+		return 0, errors.Join(errors.New("unable to execute CacheDataVacuumClean query"), err)
+	}
+	return res.RowsAffected()
+}
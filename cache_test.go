@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCached(t *testing.T) {
+	dbDir := t.TempDir()
+	db := Must1(NewLogDb(dbDir))
+
+	namespace := CacheNamespace{Name: "Test", Ttl: time.Hour, NegativeTtl: -time.Second}
+	calls := 0
+	getter := func(value string, found bool) func() (string, bool, error) {
+		return func() (string, bool, error) {
+			calls++
+			return value, found, nil
+		}
+	}
+
+	assert.Equal(t, "found", Must1(db.GetCached(namespace, "a", getter("found", true))))
+	assert.Equal(t, "found", Must1(db.GetCached(namespace, "a", getter("new", true))))
+	// Negative results are expired already with the negative TTL
+	assert.Equal(t, "<none>", Must1(db.GetCached(namespace, "b", getter("<none>", false))))
+	assert.Equal(t, "<retried>", Must1(db.GetCached(namespace, "b", getter("<retried>", true))))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []CacheStats{{Namespace: "Test", MemoryHits: 1, Misses: 3}}, db.CacheStats())
+	db.Close()
+
+	// The values survive a restart
+	db = Must1(NewLogDb(dbDir))
+	defer db.Close()
+	assert.Equal(t, "found", Must1(db.GetCached(namespace, "a", getter("new", true))))
+	assert.Equal(t, "found", Must1(db.GetCached(namespace, "a", getter("new", true))))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []CacheStats{{Namespace: "Test", MemoryHits: 1, DiskHits: 1}}, db.CacheStats())
+
+	Must1(db.GetCached(namespace, "c", getter("expired", false)))
+	assert.Equal(t, int64(1), Must1(db.CacheDataVacuumClean(MaxCacheItems)))
+	assert.Equal(t, int64(1), Must1(db.CacheDataVacuumClean(1)))
+	assert.Equal(t, int64(0), Must1(db.CacheDataVacuumClean(1)))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type FileLogSourceParams struct {
+	FilePath     string
+	StateKey     string
+	State        string
+	PollInterval time.Duration
+}
+
+// FileLogSource follows a plain log file like `tail -F`.
+// It survives copytruncate and rename rotation and resumes from the persisted inode and offset.
+// The file is used only by the ReadLine goroutine, Close just signals it to stop.
+type FileLogSource struct {
+	FileLogSourceParams
+	file      *os.File
+	reader    *bufio.Reader
+	inode     uint64
+	offset    int64
+	partial   string
+	rotated   bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFileLogSource(params FileLogSourceParams) (*FileLogSource, error) {
+	if params.FilePath == "" {
+		return nil, errors.New("file path is required for FileLogSource")
+	}
+	if params.StateKey == "" {
+		params.StateKey = "FileSourceState"
+	}
+	if params.PollInterval == 0 {
+		params.PollInterval = 500 * time.Millisecond
+	}
+	return &FileLogSource{FileLogSourceParams: params, done: make(chan struct{})}, nil
+}
+
+func (t *FileLogSource) Open() error {
+	if t.isClosed() {
+		return ErrLogSourceClosed
+	}
+
+	stateInode, stateOffset, err := parseFileSourceState(t.State)
+	if err != nil {
+		log.Warnf("Ignoring invalid file source state %q: %s", t.State, err)
+	}
+
+	if err := t.closeFile(); err != nil {
+		log.Warnf("Unable to close log file before reopening: %s", err)
+	}
+	if err := t.openFile(); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Infof("Log file %s does not exist yet, waiting for it", t.FilePath)
+			return nil
+		}
+		return err
+	}
+
+	if stateInode == t.inode && stateOffset > 0 {
+		stat, err := t.file.Stat()
+		if err != nil {
+			return errors.Join(fmt.Errorf("unable to stat log file %s", t.FilePath), err)
+		}
+
+		if stateOffset <= stat.Size() {
+			if err := t.seek(stateOffset); err != nil {
+				return err
+			}
+			log.Infof("Resuming log file %s from offset %d", t.FilePath, stateOffset)
+		} else {
+			log.Infof("Log file %s was truncated, reading from the start", t.FilePath)
+		}
+	} else if t.State != "" {
+		log.Infof("Log file %s was rotated, reading from the start", t.FilePath)
+	}
+
+	return nil
+}
+
+func (t *FileLogSource) ReadLine() (*LogSourceLine, error) {
+	for {
+		if t.isClosed() {
+			WarnIfErr(t.closeFile())
+			return nil, io.EOF
+		}
+
+		if t.reader == nil {
+			if err := t.waitForFile(); err != nil {
+				return nil, err
+			}
+		}
+
+		chunk, err := t.reader.ReadString('\n')
+		if err == nil {
+			return t.emitPartial(chunk), nil
+		}
+
+		if !errors.Is(err, io.EOF) {
+			return nil, errors.Join(fmt.Errorf("unable to read log file %s", t.FilePath), err)
+		}
+		t.partial += chunk
+
+		if t.rotated {
+			// The old file is drained, its unterminated last line won't be finished
+			if t.partial != "" {
+				return t.emitPartial(""), nil
+			}
+			log.Infof("Log file %s was rotated, reopening", t.FilePath)
+			if err := t.closeFile(); err != nil {
+				log.Warnf("Unable to close rotated log file: %s", err)
+			}
+			if err := t.openFile(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := t.checkRotation(); err != nil {
+			return nil, err
+		}
+		if t.rotated {
+			continue
+		}
+
+		select {
+		case <-t.done:
+		case <-time.After(t.PollInterval):
+		}
+	}
+}
+
+// emitPartial returns the buffered partial line finished with chunk and moves the state after it
+func (t *FileLogSource) emitPartial(chunk string) *LogSourceLine {
+	line := t.partial + chunk
+	t.partial = ""
+	t.offset += int64(len(line))
+	t.State = formatFileSourceState(t.inode, t.offset)
+	return &LogSourceLine{
+		Text:     strings.TrimRight(line, "\r\n"),
+		StateKey: t.StateKey,
+		State:    t.State,
+	}
+}
+
+func (t *FileLogSource) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+func (t *FileLogSource) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *FileLogSource) openFile() error {
+	file, err := os.Open(t.FilePath)
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to open log file %s", t.FilePath), err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		CloseOrWarn(file)
+		return errors.Join(fmt.Errorf("unable to stat log file %s", t.FilePath), err)
+	}
+
+	t.file = file
+	t.reader = bufio.NewReader(file)
+	t.inode = fileInode(stat)
+	t.offset = 0
+	t.partial = ""
+	t.rotated = false
+	return nil
+}
+
+func (t *FileLogSource) closeFile() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	t.reader = nil
+	return err
+}
+
+func (t *FileLogSource) seek(offset int64) error {
+	if _, err := t.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Join(fmt.Errorf("unable to seek log file %s", t.FilePath), err)
+	}
+	t.reader.Reset(t.file)
+	t.offset = offset
+	t.partial = ""
+	return nil
+}
+
+// checkRotation is called on EOF. A renamed file is drained once more before switching to the new one,
+// a truncated file is read from the start.
+func (t *FileLogSource) checkRotation() error {
+	stat, err := os.Stat(t.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Join(fmt.Errorf("unable to stat log file %s", t.FilePath), err)
+	}
+
+	if fileInode(stat) != t.inode {
+		t.rotated = true
+		return nil
+	}
+
+	if stat.Size() < t.offset+int64(len(t.partial)) {
+		log.Infof("Log file %s was truncated, reading from the start", t.FilePath)
+		return t.seek(0)
+	}
+
+	return nil
+}
+
+func (t *FileLogSource) waitForFile() error {
+	for {
+		err := t.openFile()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		select {
+		case <-t.done:
+			return io.EOF
+		case <-time.After(t.PollInterval):
+		}
+	}
+}
+
+func fileInode(stat os.FileInfo) uint64 {
+	if sysStat, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return sysStat.Ino
+	}
+	return 0
+}
+
+func formatFileSourceState(inode uint64, offset int64) string {
+	return fmt.Sprintf("%d:%d", inode, offset)
+}
+
+func parseFileSourceState(state string) (uint64, int64, error) {
+	if state == "" {
+		return 0, 0, nil
+	}
+
+	inodeStr, offsetStr, found := strings.Cut(state, ":")
+	if !found {
+		return 0, 0, errors.New("state must be in format inode:offset")
+	}
+
+	inode, err := strconv.ParseUint(inodeStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return inode, offset, nil
+}
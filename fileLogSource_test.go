@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLogSource(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "dumbproxy.log")
+	Must0(os.WriteFile(logPath, []byte("line 1\nline 2\n"), 0644))
+
+	src := Must1(NewFileLogSource(FileLogSourceParams{FilePath: logPath, PollInterval: 10 * time.Millisecond}))
+	assert.NoError(t, src.Open())
+	assert.Equal(t, "line 1", Must1(src.ReadLine()).Text)
+	state := Must1(src.ReadLine()).State
+	assert.NoError(t, src.Close())
+
+	appendToFile(logPath, "line 3\n")
+	src = Must1(NewFileLogSource(FileLogSourceParams{FilePath: logPath, State: state, PollInterval: 10 * time.Millisecond}))
+	assert.NoError(t, src.Open())
+	assert.Equal(t, "line 3", Must1(src.ReadLine()).Text)
+
+	// copytruncate
+	Must0(os.Truncate(logPath, 0))
+	appendToFile(logPath, "line 4\n")
+	assert.Equal(t, "line 4", Must1(src.ReadLine()).Text)
+
+	// rename rotation
+	appendToFile(logPath, "line 5\n")
+	Must0(os.Rename(logPath, logPath+".1"))
+	Must0(os.WriteFile(logPath, []byte("line 6\n"), 0644))
+	assert.Equal(t, "line 5", Must1(src.ReadLine()).Text)
+	assert.Equal(t, "line 6", Must1(src.ReadLine()).Text)
+
+	// the unterminated last line of a renamed file is kept
+	appendToFile(logPath, "line 6.5")
+	Must0(os.Rename(logPath, logPath+".2"))
+	Must0(os.WriteFile(logPath, []byte("line 6.6\n"), 0644))
+	assert.Equal(t, "line 6.5", Must1(src.ReadLine()).Text)
+	assert.Equal(t, "line 6.6", Must1(src.ReadLine()).Text)
+
+	// partial lines are returned when finished
+	appendToFile(logPath, "line")
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		appendToFile(logPath, " 7\n")
+	}()
+	line := Must1(src.ReadLine())
+	assert.Equal(t, "line 7", line.Text)
+	assert.Equal(t, "FileSourceState", line.StateKey)
+	assert.NoError(t, src.Close())
+}
+
+func TestFileLogSourceTruncatedFingerprints(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "dumbproxy.log")
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	src := Must1(NewFileLogSource(FileLogSourceParams{FilePath: logPath, PollInterval: 10 * time.Millisecond}))
+	defer CloseOrWarn(src)
+	readRecords := func(count int) []*LogLineData {
+		var items []*LogLineData
+		for i := 0; i < count; i++ {
+			line := Must1(src.ReadLine())
+			item := Must1(ParseLogLine(line.Text))
+			item.Source = "file"
+			item.SourceStateKey = line.StateKey
+			item.SourceState = line.State
+			items = append(items, item)
+		}
+		return items
+	}
+
+	Must0(os.WriteFile(logPath, []byte(
+		"Jun 18 00:07:26 host dumbproxy[1]: MAIN    : 2024/06/18 00:07:26 main.go:300: INFO     line A\n"+
+			"Jun 18 00:07:27 host dumbproxy[1]: MAIN    : 2024/06/18 00:07:27 main.go:300: INFO     line B\n",
+	), 0644))
+	assert.NoError(t, src.Open())
+	firstItems := readRecords(2)
+	assert.Equal(t, 0, Must1(db.InsertLogRecords(firstItems)))
+
+	// copytruncate: other lines of the same length and older log times get the same offsets
+	Must0(os.Truncate(logPath, 0))
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		appendToFile(logPath,
+			"Jun 18 00:07:25 host dumbproxy[1]: MAIN    : 2024/06/18 00:07:25 main.go:300: INFO     line C\n"+
+				"Jun 18 00:07:26 host dumbproxy[1]: MAIN    : 2024/06/18 00:07:26 main.go:300: INFO     line D\n",
+		)
+	}()
+	items := readRecords(2)
+	assert.Equal(t, firstItems[1].SourceState, items[1].SourceState)
+	assert.Equal(t, 0, Must1(db.InsertLogRecords(items)))
+
+	// The same lines read again are duplicates
+	for _, item := range items {
+		item.Fingerprint = ""
+	}
+	assert.Equal(t, 2, Must1(db.InsertLogRecords(items)))
+}
+
+func appendToFile(filePath string, data string) {
+	fp := Must1(os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644))
+	defer CloseOrWarn(fp)
+	Must1(fp.WriteString(data))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+type importArgs struct {
+	dbDir         string
+	source        string
+	batchSize     int
+	progressLines int
+	parserRules   string
+	proxyUnits    string
+	timezone      string
+	proxyAuth     bool
+	files         []string
+}
+
+// ImportStats counts every imported line twice: Parsed, Unmatched and ParseFailed add up to Lines,
+// and so do Stored, Duplicates and InsertFailed
+type ImportStats struct {
+	Files        int
+	FailedFiles  int
+	Lines        int
+	Parsed       int
+	Unmatched    int
+	ParseFailed  int
+	Duplicates   int
+	Stored       int
+	InsertFailed int
+}
+
+func (t ImportStats) String() string {
+	return fmt.Sprintf(
+		"files %d, failed files %d, lines %d, parsed %d, unmatched %d, parse failed %d, duplicates %d, stored %d, insert failed %d",
+		t.Files,
+		t.FailedFiles,
+		t.Lines,
+		t.Parsed,
+		t.Unmatched,
+		t.ParseFailed,
+		t.Duplicates,
+		t.Stored,
+		t.InsertFailed,
+	)
+}
+
+// runImport loads archived logs into LogRecords and exits without starting the scheduler or mailer.
+// It exits with an error when a file or a batch of records isn't imported.
+func runImport(argv []string) {
+	args := getImportArgs(argv)
+
+	startTime := time.Now()
+	stats, err := importFiles(&args)
+	fmt.Printf("Import finished in %s: %s\n", time.Since(startTime).Round(time.Millisecond), stats)
+	if err != nil {
+		log.Fatalf("Import failed: %s", err)
+	}
+}
+
+func importFiles(args *importArgs) (ImportStats, error) {
+	var stats ImportStats
+
+	location, err := LoadLocation(args.timezone)
+	if err != nil {
+		return stats, err
+	}
+	parser, err := NewLogParser(LogParserParams{
+		RulesPath: args.parserRules,
+		Units:     splitList(args.proxyUnits),
+		ProxyAuth: args.proxyAuth,
+		Location:  location,
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	db, err := NewLogDb(args.dbDir)
+	if err != nil {
+		return stats, err
+	}
+	defer db.Close()
+
+	for _, filePath := range args.files {
+		stats.Files++
+		if err := importFile(db, parser, filePath, args, &stats); err != nil {
+			log.Errorf("Import of %s failed: %s", filePath, err)
+			stats.FailedFiles++
+		}
+	}
+
+	if stats.FailedFiles > 0 || stats.InsertFailed > 0 {
+		return stats, fmt.Errorf("%d of %d files failed, %d records are not inserted", stats.FailedFiles, stats.Files, stats.InsertFailed)
+	}
+	return stats, nil
+}
+
+func getImportArgs(argv []string) importArgs {
+	var args importArgs
+	flagSet := flag.NewFlagSet("import", flag.ExitOnError)
+	flagSet.Usage = func() {
+		_, _ = fmt.Fprintf(flagSet.Output(), "Usage of import: import [flags] [file.log|file.log.gz|file.log.zst|-]...\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&args.dbDir, "dbDir", "/tmp/dumbproxy-log-monitor-test-db", "DB directory")
+	flagSet.StringVar(&args.source, "source", "import", "Log source name for imported records")
+	flagSet.IntVar(&args.batchSize, "batchSize", 1000, "Records in one insert transaction")
+	flagSet.IntVar(&args.progressLines, "progressLines", 100000, "Print progress every N lines")
+	flagSet.StringVar(&args.parserRules, "parserRules", "", "JSON file with log parser rules, built-in rules by default")
+	flagSet.StringVar(&args.proxyUnits, "proxyUnits", "", "Comma separated dumbproxy unit globs like dumbproxy@* or regexes starting with ^, overrides units of -parserRules")
+	flagSet.BoolVar(&args.proxyAuth, "proxyAuth", false, "dumbproxy requires authentication, so its requests without a user are counted as authentication failures")
+	flagSet.StringVar(&args.timezone, "timezone", "", "Timezone like Europe/Amsterdam of the log times without an offset, the system timezone by default")
+	Must0(flagSet.Parse(argv))
+
+	args.files = flagSet.Args()
+	if len(args.files) == 0 {
+		args.files = []string{"-"}
+	}
+	if args.batchSize <= 0 {
+		log.Fatalln("-batchSize should be positive")
+	}
+
+	return args
+}
+
+func importFile(db *LogDb, parser *LogParser, filePath string, args *importArgs, stats *ImportStats) error {
+	reader, closer, err := openImportFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer CloseOrWarn(closer)
+	log.Infof("Importing %s", filePath)
+
+	// Imports of the same file get the same fingerprints, so a file imported again is skipped as duplicates.
+	// Lines without a log time of their own get the time of the line before them instead of the import time,
+	// the ones at the start of the file get the time of the first line that has it.
+	fingerprinter := NewRecordFingerprinter()
+	batch := make([]*LogLineData, 0, args.batchSize)
+	var untimed []*LogLineData
+	var lastLogTime time.Time
+	add := func(data *LogLineData) {
+		data.Fingerprint = fingerprinter.Fingerprint(data)
+		batch = append(batch, data)
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if duplicates, err := db.InsertLogRecords(batch); err != nil {
+			log.Errorf("Unable to insert %d records: %s", len(batch), err)
+			stats.InsertFailed += len(batch)
+		} else {
+			stats.Duplicates += duplicates
+			stats.Stored += len(batch) - duplicates
+		}
+		batch = batch[:0]
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		stats.Lines++
+		data, err := parser.ParseLogLineOfFormat(line, DetectLogFormat(line))
+		hasLogTime := true
+		if err != nil {
+			log.Warnf("Parse log error: %s", err)
+			stats.ParseFailed++
+			data = NewParseFailureLogLine(line, err)
+			hasLogTime = false
+		} else if data.LogLineType == LogLineTypeUnmatched || data.LogLineType == LogLineTypeParseFailure {
+			stats.Unmatched++
+			hasLogTime = data.LogLineType != LogLineTypeUnmatched
+		} else {
+			stats.Parsed++
+		}
+		data.Source = args.source
+
+		switch {
+		case hasLogTime:
+			lastLogTime = data.LogTime
+			for _, item := range untimed {
+				item.LogTime = lastLogTime
+				add(item)
+			}
+			untimed = nil
+			add(data)
+		case lastLogTime.IsZero():
+			untimed = append(untimed, data)
+		default:
+			data.LogTime = lastLogTime
+			add(data)
+		}
+
+		if len(batch) >= args.batchSize {
+			flush()
+		}
+		if args.progressLines > 0 && stats.Lines%args.progressLines == 0 {
+			log.Infof("Progress: %s", stats)
+		}
+	}
+	for _, item := range untimed {
+		add(item)
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return errors.Join(fmt.Errorf("unable to read %s", filePath), err)
+	}
+	return nil
+}
+
+// openImportFile opens a plain, gzip or zstd file, "-" means STDIN
+func openImportFile(filePath string) (io.Reader, io.Closer, error) {
+	if filePath == "-" {
+		return os.Stdin, closerFunc(func() error { return nil }), nil
+	}
+
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("unable to open %s", filePath), err)
+	}
+
+	switch {
+	case strings.HasSuffix(filePath, ".gz"):
+		gzReader, err := gzip.NewReader(fp)
+		if err != nil {
+			CloseOrWarn(fp)
+			return nil, nil, errors.Join(fmt.Errorf("unable to read gzip %s", filePath), err)
+		}
+		return gzReader, fp, nil
+	case strings.HasSuffix(filePath, ".zst"):
+		zstdReader, err := zstd.NewReader(fp)
+		if err != nil {
+			CloseOrWarn(fp)
+			return nil, nil, errors.Join(fmt.Errorf("unable to read zstd %s", filePath), err)
+		}
+		return zstdReader, closerFunc(func() error {
+			zstdReader.Close()
+			return fp.Close()
+		}), nil
+	default:
+		return fp, fp, nil
+	}
+}
+
+type closerFunc func() error
+
+func (t closerFunc) Close() error {
+	return t()
+}
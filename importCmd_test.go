@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLogFormat(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		format LogFormat
+	}{
+		{readFileToString("test/data/log-line-request.txt"), LogFormatSyslog},
+		{readFileToString("test/data/log-line-journal.json"), LogFormatJournalJson},
+		{"<30>1 2024-06-18T00:07:26.123456+02:00 host dumbproxy 82403 - - PROXY   : message", LogFormatSyslogMessage},
+		{"", LogFormatSyslog},
+	} {
+		assert.Equal(t, tc.format, DetectLogFormat(tc.line), tc.line)
+	}
+}
+
+func TestOpenImportFile(t *testing.T) {
+	dir := t.TempDir()
+	content := "line 1\nline 2\n"
+
+	plainPath := path.Join(dir, "dumbproxy.log")
+	Must0(os.WriteFile(plainPath, []byte(content), 0644))
+
+	gzPath := path.Join(dir, "dumbproxy.log.gz")
+	gzFile := Must1(os.Create(gzPath))
+	gzWriter := gzip.NewWriter(gzFile)
+	Must1(gzWriter.Write([]byte(content)))
+	Must0(gzWriter.Close())
+	Must0(gzFile.Close())
+
+	zstPath := path.Join(dir, "dumbproxy.log.zst")
+	zstFile := Must1(os.Create(zstPath))
+	zstWriter := Must1(zstd.NewWriter(zstFile))
+	Must1(zstWriter.Write([]byte(content)))
+	Must0(zstWriter.Close())
+	Must0(zstFile.Close())
+
+	stdinFile := Must1(os.Open(plainPath))
+	defer CloseOrWarn(stdinFile)
+	stdin := os.Stdin
+	os.Stdin = stdinFile
+	defer func() { os.Stdin = stdin }()
+
+	for _, filePath := range []string{plainPath, gzPath, zstPath, "-"} {
+		reader, closer, err := openImportFile(filePath)
+		if !assert.NoError(t, err, filePath) {
+			continue
+		}
+		assert.Equal(t, content, string(Must1(io.ReadAll(reader))), filePath)
+		assert.NoError(t, closer.Close(), filePath)
+	}
+
+	_, _, err := openImportFile(path.Join(dir, "missing.log"))
+	assert.Error(t, err)
+	Must0(os.WriteFile(path.Join(dir, "plain.log.gz"), []byte(content), 0644))
+	_, _, err = openImportFile(path.Join(dir, "plain.log.gz"))
+	assert.Error(t, err)
+}
+
+func TestImportFiles(t *testing.T) {
+	dir := t.TempDir()
+	logPath := path.Join(dir, "dumbproxy.log")
+	Must0(os.WriteFile(logPath, []byte(strings.Join([]string{
+		"garbage before the first record",
+		readFileToString("test/data/log-line-request.txt"),
+		readFileToString("test/data/log-line-cant-dial.txt"),
+		"Jun 18 00:07:28 p487-2-am.jethelix.ru sshd[100]: Accepted publickey",
+		"{not a journal record",
+		"",
+	}, "\n")), 0644))
+
+	args := importArgs{dbDir: path.Join(dir, "db"), source: "import", batchSize: 3, files: []string{logPath}}
+	stats, err := importFiles(&args)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Files: 1, Lines: 5, Parsed: 3, Unmatched: 2, Stored: 5}, stats)
+
+	// Lines without a log time get the time of the nearest record, not the import time
+	db := Must1(NewLogDb(args.dbDir))
+	var logTimes []int64
+	Must0(db.logDb.Select(&logTimes, `SELECT LogTime FROM LogRecords WHERE LogLineType == "LogLineTypeUnmatched" ORDER BY Id`))
+	db.Close()
+	requestTime := Must1(ParseLogLine(readFileToString("test/data/log-line-request.txt"))).LogTime.Unix()
+	sshTime := Must1(ParseLogLine("Jun 18 00:07:28 p487-2-am.jethelix.ru sshd[100]: Accepted publickey")).LogTime.Unix()
+	assert.Equal(t, []int64{requestTime, sshTime}, logTimes)
+
+	// A file imported again is skipped as duplicates, including the lines without a log time
+	stats, err = importFiles(&args)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Files: 1, Lines: 5, Parsed: 3, Unmatched: 2, Duplicates: 5}, stats)
+
+	args.files = []string{logPath, path.Join(dir, "missing.log")}
+	stats, err = importFiles(&args)
+	assert.ErrorContains(t, err, "1 of 2 files failed")
+	assert.Equal(t, 2, stats.Files)
+	assert.Equal(t, 1, stats.FailedFiles)
+	assert.Equal(t, stats.Lines, stats.Parsed+stats.Unmatched+stats.ParseFailed)
+	assert.Equal(t, stats.Lines, stats.Stored+stats.Duplicates+stats.InsertFailed)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JournalEntry is a record of `journalctl -o json` output
+type JournalEntry struct {
+	Cursor            string          `json:"__CURSOR"`
+	RealtimeTimestamp string          `json:"__REALTIME_TIMESTAMP"`
+	Hostname          string          `json:"_HOSTNAME"`
+	Pid               string          `json:"_PID"`
+	SyslogPid         string          `json:"SYSLOG_PID"`
+	SyslogIdentifier  string          `json:"SYSLOG_IDENTIFIER"`
+	SystemdUnit       string          `json:"_SYSTEMD_UNIT"`
+	RawMessage        json.RawMessage `json:"MESSAGE"`
+}
+
+func ParseJournalEntry(jsonLine string) (*JournalEntry, error) {
+	var entry JournalEntry
+	if err := json.Unmarshal([]byte(jsonLine), &entry); err != nil {
+		return nil, errors.Join(errors.New("invalid journal JSON record"), err)
+	}
+	return &entry, nil
+}
+
+func (t *JournalEntry) Time() (time.Time, error) {
+	usec, err := strconv.ParseInt(t.RealtimeTimestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Join(fmt.Errorf("invalid journal timestamp: %q", t.RealtimeTimestamp), err)
+	}
+	return time.UnixMicro(usec), nil
+}
+
+func (t *JournalEntry) ProcessId() string {
+	return StrDef(t.Pid, t.SyslogPid)
+}
+
+// UnitName returns the syslog identifier, or the instance name like dumbproxy@corp
+// when the process of a templated unit logs under the plain identifier
+func (t *JournalEntry) UnitName() string {
+	unit := strings.TrimSuffix(t.SystemdUnit, ".service")
+	if t.SyslogIdentifier == "" || strings.HasPrefix(unit, t.SyslogIdentifier+"@") {
+		return StrDef(unit, t.SyslogIdentifier)
+	}
+	return t.SyslogIdentifier
+}
+
+// Message decodes MESSAGE that journalctl emits as a string or as a byte array for non UTF-8 data
+func (t *JournalEntry) Message() (string, error) {
+	if len(t.RawMessage) == 0 || string(t.RawMessage) == "null" {
+		return "", nil
+	}
+
+	var msg string
+	if err := json.Unmarshal(t.RawMessage, &msg); err == nil {
+		return msg, nil
+	}
+
+	var msgBytes []byte
+	var byteValues []int
+	if err := json.Unmarshal(t.RawMessage, &byteValues); err != nil {
+		return "", errors.Join(errors.New("invalid journal MESSAGE field"), err)
+	}
+	for _, val := range byteValues {
+		msgBytes = append(msgBytes, byte(val))
+	}
+	return string(msgBytes), nil
+}
+
+// IsJournalCommand tells if the log command is a journalctl call that supports cursors
+func IsJournalCommand(command string) bool {
+	for _, part := range strings.Fields(command) {
+		if path.Base(part) == "journalctl" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJournalEntry(t *testing.T) {
+	entry, err := ParseJournalEntry(readFileToString("test/data/log-line-journal.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "s=6b3f0b6f1b6d4c5e9d8e8c1c2a3b4c5d;i=1a2b3;b=0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f;m=2f4e3c1a;t=61b2c3d4e5f60;x=9a8b7c6d5e4f3a2b", entry.Cursor)
+	assert.Equal(t, time.UnixMicro(1718669246123456), Must1(entry.Time()))
+	assert.Equal(t, "82403", entry.ProcessId())
+	assert.Equal(t, "PROXY   : 2024/06/18 00:07:26 handler.go:138: INFO     Request: 143.178.228.182:64154 => 2.56.204.64:443 \"andre487\" HTTP/1.1 GET http://ifconfig.co/", Must1(entry.Message()))
+
+	entry, err = ParseJournalEntry(`{"MESSAGE":[72,105,255]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi\xff", Must1(entry.Message()))
+
+	entry, err = ParseJournalEntry(`{"SYSLOG_IDENTIFIER":"dumbproxy","_SYSTEMD_UNIT":"dumbproxy@corp.service"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "dumbproxy@corp", entry.UnitName())
+
+	entry, err = ParseJournalEntry(`{"SYSLOG_IDENTIFIER":"sudo","_SYSTEMD_UNIT":"session-1.scope"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "sudo", entry.UnitName())
+
+	_, err = ParseJournalEntry("Jun 18 00:07:26 host dumbproxy[1]: FOO")
+	assert.ErrorContains(t, err, "invalid journal JSON record")
+}
+
+func TestIsJournalCommand(t *testing.T) {
+	assert.True(t, IsJournalCommand("sudo journalctl -fu dumbproxy.service"))
+	assert.True(t, IsJournalCommand("/usr/bin/journalctl -f"))
+	assert.False(t, IsJournalCommand("go run ."))
+}
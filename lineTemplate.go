@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// MaxLineTemplateLen limits the templates of long lines
+const MaxLineTemplateLen = 300
+
+// lineTemplateMasks are applied in order, so times and addresses aren't split into numbers
+var lineTemplateMasks = []struct {
+	re   *regexp.Regexp
+	mask string
+}{
+	{regexp.MustCompile(`\b\d{4}[/-]\d{2}[/-]\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?\b`), "<date>"},
+	{regexp.MustCompile(`\b\d{1,2}:\d{2}:\d{2}(?:\.\d+)?\b`), "<time>"},
+	{regexp.MustCompile(`\b(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\b`), "<month>"},
+	{regexp.MustCompile(`\[[0-9a-fA-F:.]*:[0-9a-fA-F:.]*\]`), "[<ip>]"},
+	{regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`), "<ip>"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{0,4}){2,7}\b`), "<ip>"},
+}
+
+var lineTemplateHexRe = regexp.MustCompile(`\b(?:0x[0-9a-fA-F]+|[0-9a-fA-F]{6,})\b`)
+var lineTemplateNumRe = regexp.MustCompile(`\b\d+\b`)
+var lineTemplateSpaceRe = regexp.MustCompile(`\s+`)
+
+// lineTemplate clusters similar lines masking dates, times, IPs, hex strings and numbers
+func lineTemplate(line string) string {
+	res := line
+	for _, mask := range lineTemplateMasks {
+		res = mask.re.ReplaceAllString(res, mask.mask)
+	}
+	res = lineTemplateHexRe.ReplaceAllStringFunc(res, func(token string) string {
+		hasDigit := strings.IndexFunc(token, unicode.IsDigit) >= 0
+		hasLetter := strings.IndexFunc(token, unicode.IsLetter) >= 0
+		if strings.HasPrefix(token, "0x") || hasDigit && hasLetter {
+			return "<hex>"
+		}
+		return token
+	})
+	res = lineTemplateNumRe.ReplaceAllString(res, "<num>")
+	res = strings.TrimSpace(lineTemplateSpaceRe.ReplaceAllString(res, " "))
+
+	if len(res) > MaxLineTemplateLen {
+		res = strings.ToValidUTF8(res[:MaxLineTemplateLen], "")
+	}
+	return res
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineTemplate(t *testing.T) {
+	for line, expected := range map[string]string{
+		"Jun 18 00:07:26 p487-2-am.jethelix.ru dumbproxy[82403]: FOO 143.178.228.182:64154 bar":       "<month> <num> <time> p487-<num>-am.jethelix.ru dumbproxy[<num>]: FOO <ip>:<num> bar",
+		"PROXY   : 2024/06/18 00:07:26 handler.go:138: INFO     upstream [2a02:6b8::5d7]:443 is slow": "PROXY : <date> handler.go:<num>: INFO upstream [<ip>]:<num> is slow",
+		"session 5f2a9c31d4e8 of 2a02:6b8::1 closed after 0x1f ms, deadbeef accepted":                 "session <hex> of <ip> closed after <hex> ms, deadbeef accepted",
+		"journal entry at 2024-06-18T00:07:26.123456Z with 12 fields":                                 "journal entry at <date> with <num> fields",
+	} {
+		assert.Equal(t, expected, lineTemplate(line), line)
+	}
+}
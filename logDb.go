@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -15,9 +20,52 @@ import (
 )
 
 type LogDb struct {
+	dbDir   string
 	logDb   *sqlx.DB
 	kvDb    *sqlx.DB
 	cacheDb *sqlx.DB
+
+	// rollupLocation is the timezone of the days of the daily rollups
+	rollupLocation *time.Location
+
+	writerStatsLock sync.Mutex
+	writerStats     LogWriterStats
+
+	// cacheItems is the in-memory front of cacheDb
+	cacheLock  sync.Mutex
+	cacheItems map[string]cacheItem
+	cacheStats map[string]*CacheStats
+}
+
+type LogWriterParams struct {
+	// BatchSize is the max number of records in one insert transaction
+	BatchSize int
+	// FlushInterval is the max time a record waits in the batch
+	FlushInterval time.Duration
+}
+
+// LogWriterStats shows the writer throughput and how far behind the logs it is
+type LogWriterStats struct {
+	StartTime     time.Time
+	Records       int64
+	FailedRecords int64
+	// Duplicates are records that were read again after a restart and skipped
+	Duplicates        int64
+	Batches           int64
+	LastBatchSize     int
+	LastBatchDuration time.Duration
+	// QueueLen is the number of records waiting in the channel at the last flush
+	QueueLen int
+	// Lag is the delay between the log time of the last stored record and its storing
+	Lag time.Duration
+}
+
+func (t LogWriterStats) RecordsPerSecond() float64 {
+	elapsed := time.Since(t.StartTime).Seconds()
+	if t.StartTime.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Records) / elapsed
 }
 
 type BasicGroupReportData struct {
@@ -25,31 +73,222 @@ type BasicGroupReportData struct {
 	LastId    uint64 `db:"LastId"`
 	FirstTs   int64  `db:"FirstTs"`
 	LastTs    int64  `db:"LastTs"`
-	FirstTime string `db:"FirstTime"`
-	LastTime  string `db:"LastTime"`
+	FirstTime time.Time
+	LastTime  time.Time
 }
 
 type SrcIpReportData struct {
 	BasicGroupReportData
 	SrcIp   string `db:"SrcIp"`
+	Sources string `db:"Sources"`
 	SrcHost string
 }
 
 type UsersReportData struct {
 	BasicGroupReportData
 	Username string `db:"Username"`
+	Sources  string `db:"Sources"`
+}
+
+type SourcesReportData struct {
+	BasicGroupReportData
+	Source   string `db:"Source"`
+	Instance string `db:"Instance"`
+	Errors   int    `db:"Errors"`
+}
+
+type UpstreamErrorsReportData struct {
+	BasicGroupReportData
+	ErrorClass string `db:"ErrorClass"`
+	UpstreamOp string `db:"UpstreamOp"`
+	DestIp     string `db:"DestIp"`
+	DestPort   int    `db:"DestPort"`
+	AddrFamily string `db:"AddrFamily"`
+	Sources    string `db:"Sources"`
+}
+
+type TlsNoiseReportData struct {
+	BasicGroupReportData
+	SrcIp   string `db:"SrcIp"`
+	Ports   int    `db:"Ports"`
+	Reasons string `db:"Reasons"`
+	Sources string `db:"Sources"`
+	SrcHost string
+}
+
+type SitesReportData struct {
+	BasicGroupReportData
+	SiteDomain string `db:"SiteDomain"`
+	Hosts      int    `db:"Hosts"`
+	Users      string `db:"Users"`
+	Schemes    string `db:"Schemes"`
+	Sources    string `db:"Sources"`
+}
+
+type UserStatusesReportData struct {
+	BasicGroupReportData
+	Username string `db:"Username"`
+	Status   int    `db:"Status"`
+	Sources  string `db:"Sources"`
+}
+
+type UnknownLinesReportData struct {
+	BasicGroupReportData
+	LineTemplate string `db:"LineTemplate"`
+	Types        string `db:"Types"`
+	Reasons      string `db:"Reasons"`
+	Example      string `db:"Example"`
+	Sources      string `db:"Sources"`
+}
+
+// ParserCoverageReportData counts the lines of dumbproxy units and the lines that aren't recognized
+type ParserCoverageReportData struct {
+	Lines   int    `db:"Lines"`
+	Unknown int    `db:"Unknown"`
+	LastId  uint64 `db:"LastId"`
+}
+
+// Coverage is the percent of the recognized lines
+func (t ParserCoverageReportData) Coverage() float64 {
+	if t.Lines == 0 {
+		return 100
+	}
+	return float64(t.Lines-t.Unknown) * 100 / float64(t.Lines)
+}
+
+type AuthFailuresReportData struct {
+	BasicGroupReportData
+	Username string `db:"Username"`
+	SrcIp    string `db:"SrcIp"`
+	Reasons  string `db:"Reasons"`
+	Sources  string `db:"Sources"`
+	SrcHost  string
+}
+
+// AuthFailuresAlertData is a user or a source IP with too many authentication failures
+type AuthFailuresAlertData struct {
+	// Kind is user or ip
+	Kind     string `db:"Kind"`
+	Name     string `db:"Name"`
+	Failures int    `db:"Failures"`
 }
 
 type LogLineDataInsertData struct {
 	*LogLineData
 	Ts          int64  `db:"Ts"`
 	LogTime     int64  `db:"LogTime"`
+	LogTimeUs   int64  `db:"LogTimeUs"`
 	LogLineType string `db:"LogLineType"`
 }
 
 const QueryTimeout = 10 * time.Second
 
+// FingerprintOccurrencesWindow is how long the occurrences of the lines without a source position are counted
+// after the newest line of a stream, lines that come later than that are counted from zero again
+const FingerprintOccurrencesWindow = time.Minute
+
+// RequestCorrelationWindow is the max time between the Request: line and the HTTP status line of one request
+const RequestCorrelationWindow = 15 * time.Minute
+
+// sqliteFileParams enables WAL, so readers don't block the writer and commits don't need a full fsync
+const sqliteFileParams = "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000"
+
+// sqliteReadOnlyParams opens an existing DB without the journal mode pragma, which would write to it
+const sqliteReadOnlyParams = "?mode=ro&_busy_timeout=5000"
+
+const logRecordsInsertQuery = `
+	INSERT INTO
+		LogRecords (
+			Ts, 
+			Source, 
+			LogLineType, 
+			LogLine, 
+			LogTime, 
+			LogTimeUs, 
+			IsError, 
+			HasRequestInfo, 
+			Host, 
+			Pid, 
+			Instance, 
+			FileName, 
+			FileLine, 
+			SrcIp, 
+			SrcPort, 
+			DestIp, 
+			DestPort, 
+			AddrFamily, 
+			UpstreamOp, 
+			ErrorClass, 
+			Username, 
+			Proto, 
+			Method, 
+			Url, 
+			Status, 
+			ErrorMessage, 
+			ErrorReason, 
+			AuthOutcome, 
+			UrlScheme, 
+			UrlHost, 
+			UrlPort, 
+			UrlPath, 
+			SiteDomain, 
+			LineTemplate, 
+			Fingerprint
+		)
+	VALUES 
+		(
+		 	:Ts, 
+			:Source, 
+			:LogLineType, 
+			:LogLine, 
+			:LogTime, 
+			:LogTimeUs, 
+			:IsError, 
+			:HasRequestInfo, 
+			:Host, 
+			:Pid, 
+			:Instance, 
+			:FileName, 
+			:FileLine, 
+			:SrcIp, 
+			:SrcPort, 
+			:DestIp, 
+			:DestPort, 
+			:AddrFamily, 
+			:UpstreamOp, 
+			:ErrorClass, 
+			:Username, 
+			:Proto, 
+			:Method, 
+			:Url, 
+			:Status, 
+			:ErrorMessage, 
+			:ErrorReason, 
+			:AuthOutcome, 
+			:UrlScheme, 
+			:UrlHost, 
+			:UrlPort, 
+			:UrlPath, 
+			:SiteDomain, 
+			:LineTemplate, 
+			:Fingerprint
+		)
+`
+
 func NewLogDb(dbDir string) (*LogDb, error) {
+	res, err := OpenLogDb(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.Init(); err != nil {
+		res.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// OpenLogDb opens the DBs without migrating them, NewLogDb should be used to work with records
+func OpenLogDb(dbDir string) (*LogDb, error) {
 	dbDirStat, err := os.Stat(dbDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -63,33 +302,62 @@ func NewLogDb(dbDir string) (*LogDb, error) {
 		return nil, errors.Join(fmt.Errorf("dbDir is not a dir: %s", dbDirStat), err)
 	}
 
+	return openDbFiles(dbDir, func(dbPath string) string {
+		return dbPath + sqliteFileParams
+	})
+}
+
+// OpenLogDbReadOnly opens the DBs for reading only, it doesn't create the files or change their journal mode.
+// log.db must exist, a missing kv.db or cache.db of an older version is read as an empty DB.
+func OpenLogDbReadOnly(dbDir string) (*LogDb, error) {
+	logDbPath := path.Join(dbDir, "log.db")
+	if _, err := os.Stat(logDbPath); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to open %s read-only", logDbPath), err)
+	}
+
+	return openDbFiles(dbDir, func(dbPath string) string {
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return ":memory:"
+		}
+		// A read-only connection leaves -wal and -shm files behind, a DB without them was closed cleanly and has nothing to read there
+		if _, err := os.Stat(dbPath + "-wal"); os.IsNotExist(err) {
+			return "file:" + dbPath + sqliteReadOnlyParams + "&immutable=1"
+		}
+		return "file:" + dbPath + sqliteReadOnlyParams
+	})
+}
+
+func openDbFiles(dbDir string, dataSourceName func(dbPath string) string) (*LogDb, error) {
 	logDbPath := path.Join(dbDir, "log.db")
 	kvDbPath := path.Join(dbDir, "kv.db")
+	cacheDbPath := path.Join(dbDir, "cache.db")
 
-	logDb, err := sqlx.Open("sqlite3", logDbPath)
+	logDb, err := sqlx.Open("sqlite3", dataSourceName(logDbPath))
 	if err != nil {
 		return nil, errors.Join(fmt.Errorf("unable to execute sql.Open for logDb: %s", logDbPath), err)
 	}
 
-	kvDb, err := sqlx.Open("sqlite3", kvDbPath)
+	kvDb, err := sqlx.Open("sqlite3", dataSourceName(kvDbPath))
 	if err != nil {
 		return nil, errors.Join(fmt.Errorf("unable to execute sql.Open for kvDb: %s", kvDbPath), err)
 	}
 
-	cacheDb, err := sqlx.Open("sqlite3", "file:cacheDb?mode=memory")
+	cacheDb, err := sqlx.Open("sqlite3", dataSourceName(cacheDbPath))
 	if err != nil {
-		return nil, errors.Join(fmt.Errorf("unable to execute sql.Open for cacheDb: %s", kvDbPath), err)
+		return nil, errors.Join(fmt.Errorf("unable to execute sql.Open for cacheDb: %s", cacheDbPath), err)
 	}
 
-	res := &LogDb{
+	return &LogDb{
+		dbDir:   dbDir,
 		logDb:   logDb,
 		kvDb:    kvDb,
 		cacheDb: cacheDb,
-	}
-	if err := res.Init(); err != nil {
-		return nil, err
-	}
-	return res, nil
+
+		rollupLocation: time.UTC,
+
+		cacheItems: make(map[string]cacheItem),
+		cacheStats: make(map[string]*CacheStats),
+	}, nil
 }
 
 func (t *LogDb) Close() {
@@ -99,31 +367,24 @@ func (t *LogDb) Close() {
 }
 
 func (t *LogDb) Init() error {
-	err := t.initSchema()
-	if err != nil {
-		return err
-	}
-
-	err = t.checkSchemaVersion()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err := t.Migrate()
+	return err
 }
 
-func (t *LogDb) GetSrcIpReportData(fromId int) ([]SrcIpReportData, error) {
-	log.Tracef("Executing GetSrcIpReportData(%d)", fromId)
+func (t *LogDb) GetSrcIpReportData(fromId int, sources []string) ([]SrcIpReportData, error) {
+	log.Tracef("Executing GetSrcIpReportData(%d, %v)", fromId, sources)
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
 	var items []SrcIpReportData
 	err := t.logDb.SelectContext(
 		ctx,
 		&items,
-		`
+		fmt.Sprintf(`
 		SELECT 
 		    SrcIp,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
 		    COUNT(*) AS Reqs,
 		    MAX(Id) AS LastId,
 		    MIN(Ts) AS FirstTs,
@@ -133,14 +394,15 @@ func (t *LogDb) GetSrcIpReportData(fromId int) ([]SrcIpReportData, error) {
 		WHERE
 			Id > ?
 			AND LogLineType == "LogLineTypeProxyRequest"
+			%s
 		GROUP BY 
 		    SrcIp
 		HAVING
 		    Reqs >= 5
 		ORDER BY
 		    Reqs DESC
-		`,
-		fromId,
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
 	)
 	if err != nil {
 		return nil, errors.Join(errors.New("error when GetSrcIpReportData"), err)
@@ -153,18 +415,20 @@ func (t *LogDb) GetSrcIpReportData(fromId int) ([]SrcIpReportData, error) {
 	return items, nil
 }
 
-func (t *LogDb) GetUsersReportData(fromId int) ([]UsersReportData, error) {
-	log.Tracef("Executing GetUsersReportData(%d)", fromId)
+func (t *LogDb) GetUsersReportData(fromId int, sources []string) ([]UsersReportData, error) {
+	log.Tracef("Executing GetUsersReportData(%d, %v)", fromId, sources)
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
 	var items []UsersReportData
 	err := t.logDb.SelectContext(
 		ctx,
 		&items,
-		`
+		fmt.Sprintf(`
 		SELECT 
 		    Username,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
 		    COUNT(*) AS Reqs,
 		    MAX(Id) AS LastId,
 		    MIN(Ts) AS FirstTs,
@@ -174,12 +438,13 @@ func (t *LogDb) GetUsersReportData(fromId int) ([]UsersReportData, error) {
 		WHERE
 			Id > ?
 			AND LogLineType == "LogLineTypeProxyRequest"
+			%s
 		GROUP BY 
 		    Username
 		ORDER BY
 		    Reqs DESC
-		`,
-		fromId,
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
 	)
 	if err != nil {
 		return nil, errors.Join(errors.New("error when GetUsersReportData"), err)
@@ -192,23 +457,418 @@ func (t *LogDb) GetUsersReportData(fromId int) ([]UsersReportData, error) {
 	return items, nil
 }
 
-func (t *LogDb) SetLastHandledLogTimeNow() error {
-	return t.SetLastHandledLogTime(time.Now())
+func (t *LogDb) GetSourcesReportData(fromId int, sources []string) ([]SourcesReportData, error) {
+	log.Tracef("Executing GetSourcesReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []SourcesReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    Source,
+		    Instance,
+		    SUM(LogLineType == "LogLineTypeProxyRequest") AS Reqs,
+		    SUM(IsError) AS Errors,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			%s
+			AND LogLineType NOT IN ("LogLineTypeUnmatched", "LogLineTypeOtherUnit")
+		GROUP BY 
+		    Source,
+		    Instance
+		ORDER BY
+		    Source,
+		    Instance
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetSourcesReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].Source = StrDef(items[i].Source, "<empty>")
+		items[i].Instance = StrDef(items[i].Instance, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+func (t *LogDb) GetUpstreamErrorsReportData(fromId int, sources []string) ([]UpstreamErrorsReportData, error) {
+	log.Tracef("Executing GetUpstreamErrorsReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []UpstreamErrorsReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    ErrorClass,
+		    UpstreamOp,
+		    DestIp,
+		    DestPort,
+		    AddrFamily,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND LogLineType == "LogLineTypeProxyRequestError"
+			AND UpstreamOp != ""
+			%s
+		GROUP BY 
+		    ErrorClass,
+		    UpstreamOp,
+		    DestIp,
+		    DestPort
+		ORDER BY
+		    Reqs DESC
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetUpstreamErrorsReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].DestIp = StrDef(items[i].DestIp, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+func (t *LogDb) GetTlsNoiseReportData(fromId int, sources []string) ([]TlsNoiseReportData, error) {
+	log.Tracef("Executing GetTlsNoiseReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []TlsNoiseReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    SrcIp,
+		    COUNT(DISTINCT SrcPort) AS Ports,
+		    GROUP_CONCAT(DISTINCT ErrorReason) AS Reasons,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND LogLineType == "LogLineTypeTlsHandshakeError"
+			%s
+		GROUP BY 
+		    SrcIp
+		HAVING
+		    Reqs >= 5
+		ORDER BY
+		    Reqs DESC
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetTlsNoiseReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].SrcIp = StrDef(items[i].SrcIp, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+// GetSitesReportData returns requests by the registrable domain of the destination
+func (t *LogDb) GetSitesReportData(fromId int, sources []string) ([]SitesReportData, error) {
+	log.Tracef("Executing GetSitesReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []SitesReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    SiteDomain,
+		    COUNT(DISTINCT UrlHost) AS Hosts,
+		    GROUP_CONCAT(DISTINCT Username) AS Users,
+		    GROUP_CONCAT(DISTINCT UrlScheme) AS Schemes,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND LogLineType == "LogLineTypeProxyRequest"
+			%s
+		GROUP BY 
+		    SiteDomain
+		ORDER BY
+		    Reqs DESC
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetSitesReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].SiteDomain = StrDef(items[i].SiteDomain, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+// GetUserStatusesReportData returns status codes of the correlated plain HTTP requests by user
+func (t *LogDb) GetUserStatusesReportData(fromId int, sources []string) ([]UserStatusesReportData, error) {
+	log.Tracef("Executing GetUserStatusesReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []UserStatusesReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    Username,
+		    Status,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(HttpInfoRecordId) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    ProxyRequests
+		WHERE
+			HttpInfoRecordId > ?
+			%s
+		GROUP BY 
+		    Username,
+		    Status
+		ORDER BY
+		    Username,
+		    Reqs DESC
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetUserStatusesReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].Username = StrDef(items[i].Username, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+// unknownLineTypes are the types of the lines that the parser doesn't recognize
+const unknownLineTypes = `("LogLineTypeUnmatched", "LogLineTypeProxyUnknown", "LogLineTypeParseFailure")`
+
+// MaxUnknownLineTemplates limits the templates of the unknown lines in the report
+const MaxUnknownLineTemplates = 50
+
+func (t *LogDb) GetUnknownLinesReportData(fromId int, sources []string) ([]UnknownLinesReportData, error) {
+	log.Tracef("Executing GetUnknownLinesReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []UnknownLinesReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    LineTemplate,
+		    GROUP_CONCAT(DISTINCT LogLineType) AS Types,
+		    GROUP_CONCAT(DISTINCT ErrorReason) AS Reasons,
+		    MAX(LogLine) AS Example,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND LogLineType IN %s
+			%s
+		GROUP BY 
+		    LineTemplate
+		ORDER BY
+		    Reqs DESC
+		LIMIT %d
+		`, unknownLineTypes, sourcesCond, MaxUnknownLineTemplates),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetUnknownLinesReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].LineTemplate = StrDef(items[i].LineTemplate, "<empty>")
+		items[i].Reasons = StrDef(items[i].Reasons, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+func (t *LogDb) GetParserCoverageReportData(fromId int, sources []string) (*ParserCoverageReportData, error) {
+	log.Tracef("Executing GetParserCoverageReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var res ParserCoverageReportData
+	err := t.logDb.GetContext(
+		ctx,
+		&res,
+		fmt.Sprintf(`
+		SELECT 
+		    COUNT(*) AS Lines,
+		    COALESCE(SUM(LogLineType IN %s), 0) AS Unknown,
+		    COALESCE(MAX(Id), 0) AS LastId
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND LogLineType != "LogLineTypeOtherUnit"
+			%s
+		`, unknownLineTypes, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetParserCoverageReportData"), err)
+	}
+	return &res, nil
+}
+
+func (t *LogDb) GetAuthFailuresReportData(fromId int, sources []string) ([]AuthFailuresReportData, error) {
+	log.Tracef("Executing GetAuthFailuresReportData(%d, %v)", fromId, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []AuthFailuresReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT 
+		    Username,
+		    SrcIp,
+		    GROUP_CONCAT(DISTINCT ErrorClass) AS Reasons,
+		    GROUP_CONCAT(DISTINCT Source) AS Sources,
+		    COUNT(*) AS Reqs,
+		    MAX(Id) AS LastId,
+		    MIN(Ts) AS FirstTs,
+		    MAX(Ts) AS LastTs
+		FROM 
+		    LogRecords
+		WHERE
+			Id > ?
+			AND AuthOutcome == "failure"
+			%s
+		GROUP BY 
+		    Username,
+		    SrcIp
+		ORDER BY
+		    Reqs DESC
+		`, sourcesCond),
+		append([]interface{}{fromId}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetAuthFailuresReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].Username = StrDef(items[i].Username, "<empty>")
+		items[i].SrcIp = StrDef(items[i].SrcIp, "<empty>")
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+// GetAuthFailuresAlertData returns users and source IPs with at least threshold authentication failures logged since the time
+func (t *LogDb) GetAuthFailuresAlertData(since time.Time, threshold int) ([]AuthFailuresAlertData, error) {
+	log.Tracef("Executing GetAuthFailuresAlertData(%s, %d)", since, threshold)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	var items []AuthFailuresAlertData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		`
+		SELECT "user" AS Kind, Username AS Name, COUNT(*) AS Failures
+		FROM LogRecords
+		WHERE LogTime >= ? AND AuthOutcome == "failure" AND Username != ""
+		GROUP BY Username
+		HAVING Failures >= ?
+		UNION ALL
+		SELECT "ip" AS Kind, SrcIp AS Name, COUNT(*) AS Failures
+		FROM LogRecords
+		WHERE LogTime >= ? AND AuthOutcome == "failure" AND SrcIp != ""
+		GROUP BY SrcIp
+		HAVING Failures >= ?
+		ORDER BY Failures DESC
+		`,
+		since.Unix(), threshold, since.Unix(), threshold,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetAuthFailuresAlertData"), err)
+	}
+	return items, nil
 }
 
-func (t *LogDb) SetLastHandledLogTime(lastTime time.Time) error {
-	log.Tracef("Executing SetLastHandledLogTime(%s)", lastTime)
-	return t.SetKvRecord("LastLogTime", lastTime.Unix())
+func (t *LogDb) SetLastHandledLogTime(sourceName string, lastTime time.Time) error {
+	log.Tracef("Executing SetLastHandledLogTime(%s, %s)", sourceName, lastTime)
+	return t.SetKvRecord(SourceStateKey(sourceName, "LastLogTime"), formatStateTime(lastTime))
 }
 
-func (t *LogDb) GetLastHandledTime() (time.Time, error) {
-	log.Trace("Executing GetLastHandledTime()")
-	ts, err := t.GetKvIntRecord("LastLogTime")
+func (t *LogDb) GetLastHandledTime(sourceName string) (time.Time, error) {
+	log.Tracef("Executing GetLastHandledTime(%s)", sourceName)
+	val, err := t.GetKvStrRecord(SourceStateKey(sourceName, "LastLogTime"))
 	if err != nil {
 		return time.Time{}, errors.Join(errors.New("unable to GetLastHandledTime"), err)
 	}
 
-	tm := time.Unix(int64(ts), 0)
+	tm, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		// Older versions stored Unix seconds
+		ts, _ := strconv.ParseInt(val, 10, 64)
+		tm = time.Unix(ts, 0).UTC()
+	}
 	if tm.Year() < 2024 {
 		tm = time.Unix(time.Now().Unix()-int64(7*24*time.Hour/time.Second), 0)
 	}
@@ -268,293 +928,586 @@ func (t *LogDb) SetKvRecord(key string, val interface{}) error {
 	return nil
 }
 
-func (t *LogDb) LogRecordsVacuumClean(maxAge time.Duration) (int64, error) {
-	log.Tracef("Executing LogRecordsVacuumClean(%d)", maxAge)
+// SetKvRecords sets several records in one transaction
+func (t *LogDb) SetKvRecords(records map[string]interface{}) error {
+	log.Tracef("Executing SetKvRecords(%d records)", len(records))
+	if len(records) == 0 {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
-	borderTs := time.Now().Unix() - int64(maxAge/time.Second)
-	res, err := t.logDb.ExecContext(ctx, `DELETE FROM LogRecords WHERE Ts < ?`, borderTs)
+	tx, err := t.kvDb.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
-		return 0, errors.Join(errors.New("unable to execute LogRecordsVacuumClean query"), err)
+		return errors.Join(errors.New("unable to start SetKvRecords transaction"), err)
 	}
-	return res.RowsAffected()
+	for key, val := range records {
+		if _, err := tx.ExecContext(ctx, `REPLACE INTO KvData (Name, Value) VALUES (?, CAST(? AS TEXT))`, key, val); err != nil {
+			WarnIfErr(tx.Rollback())
+			return errors.Join(errors.New("unable to execute SetKvRecords query"), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Join(errors.New("unable to commit SetKvRecords transaction"), err)
+	}
+	return nil
 }
 
-func (t *LogDb) CacheDataVacuumClean(maxItems int) (int64, error) {
-	log.Tracef("Executing CachedDataVacuumClean()")
+// LogRecordsVacuumClean deletes records older than their retention and the oldest records above the size cap.
+// Records are added to the rollups first, so the long-term stats keep them, and archived when it's enabled.
+func (t *LogDb) LogRecordsVacuumClean(params RetentionParams) (int64, error) {
+	log.Tracef("Executing LogRecordsVacuumClean(%+v)", params)
+	if err := t.RollupLogRecords(); err != nil {
+		return 0, err
+	}
+
+	// Every record gets the retention of the first rule it matches
+	var total int64
+	now := time.Now()
+	var prevConds []string
+	var prevArgs []interface{}
+	rules := append(append([]RetentionRule{}, params.Rules...), RetentionRule{maxAge: params.MaxAge})
+	for _, rule := range rules {
+		ruleCond, ruleArgs := rule.condition()
+		cond := `Ts < ? AND ` + ruleCond
+		for _, prevCond := range prevConds {
+			cond += ` AND NOT ` + prevCond
+		}
+		args := append(append([]interface{}{now.Add(-rule.maxAge).Unix()}, ruleArgs...), prevArgs...)
+
+		for {
+			deleted, err := t.deleteLogRecords(cond, args, VacuumBatchSize, params.ArchiveDir)
+			total += deleted
+			if err != nil {
+				return total, err
+			}
+			if deleted < VacuumBatchSize {
+				break
+			}
+		}
+
+		prevConds = append(prevConds, ruleCond)
+		prevArgs = append(prevArgs, ruleArgs...)
+	}
+
+	if params.MaxDbSize > 0 {
+		deleted, err := t.trimLogRecordsToSize(params.MaxDbSize, params.ArchiveDir)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
-	now := time.Now().Unix()
-	res, err := t.cacheDb.ExecContext(
+	// Requests are kept while any of their lines is kept
+	_, err := t.logDb.ExecContext(
 		ctx,
-		`
-		DELETE FROM 
-		   CacheData 
-	   	WHERE 
-	   	    ExpiresTs >= ? 
-			OR Key IN (
-				SELECT 
-					Key 
-				FROM 
-					CacheData
-				ORDER BY
-	   				ExpiresTs
-	   			LIMIT
-	   				-1
-	   			OFFSET
-	   				?
-			) 
-		`,
-		now,
-		maxItems,
+		`DELETE FROM ProxyRequests
+		WHERE
+			RequestRecordId NOT IN (SELECT Id FROM LogRecords)
+			AND HttpInfoRecordId NOT IN (SELECT Id FROM LogRecords)`,
 	)
 	if err != nil {
-		return 0, errors.Join(errors.New("unable to execute CacheDataVacuumClean query"), err)
+		return total, errors.Join(errors.New("unable to execute LogRecordsVacuumClean query for ProxyRequests"), err)
 	}
-	return res.RowsAffected()
+	return total, nil
 }
 
-func (t *LogDb) WriteRecordsFromChannel(logCh chan *LogLineData) {
-	log.Trace("Executing WriteRecordsFromChannel(logCh, wg)")
-	defer log.Infoln("WriteRecordsFromChannel is finished")
+// VacuumBatchSize is the max number of records deleted and archived at once
+const VacuumBatchSize = 10000
+
+// LogRecordsSizeSample is the number of the latest records the average record size is estimated by
+const LogRecordsSizeSample = 1000
+
+// deleteLogRecords deletes up to limit oldest records matching the condition.
+// With archiveDir the records are written to the archive before they are deleted.
+func (t *LogDb) deleteLogRecords(cond string, args []interface{}, limit int64, archiveDir string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	if archiveDir == "" {
+		res, err := t.logDb.ExecContext(
+			ctx,
+			fmt.Sprintf(`DELETE FROM LogRecords WHERE Id IN (SELECT Id FROM LogRecords WHERE %s ORDER BY Id LIMIT ?)`, cond),
+			append(args, limit)...,
+		)
+		if err != nil {
+			return 0, errors.Join(errors.New("unable to delete log records"), err)
+		}
+		return res.RowsAffected()
+	}
 
-	insertQuery, err := t.logDb.PrepareNamed(`
-		INSERT INTO
-			LogRecords (
-				Ts, 
-				LogLineType, 
-				LogLine, 
-				LogTime, 
-				IsError, 
-				HasRequestInfo, 
-				Host, 
-				Pid, 
-				FileName, 
-				FileLine, 
-				SrcIp, 
-				DestIp, 
-				DestPort, 
-				Username, 
-				Proto, 
-				Method, 
-				Url, 
-				Status, 
-				ErrorMessage
-			)
-		VALUES 
-			(
-			 	:Ts, 
-				:LogLineType, 
-				:LogLine, 
-				:LogTime, 
-				:IsError, 
-				:HasRequestInfo, 
-				:Host, 
-				:Pid, 
-				:FileName, 
-				:FileLine, 
-				:SrcIp, 
-				:DestIp, 
-				:DestPort, 
-				:Username, 
-				:Proto, 
-				:Method, 
-				:Url, 
-				:Status, 
-				:ErrorMessage
-			)
-	`)
+	var items []ArchivedLogRecord
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`SELECT * FROM LogRecords WHERE %s ORDER BY Id LIMIT ?`, cond),
+		append(args, limit)...,
+	)
 	if err != nil {
-		log.Panicf("unable to prepare insert query in WriteRecordsFromChannel: %s", err)
+		return 0, errors.Join(errors.New("unable to select log records to archive"), err)
+	}
+	if len(items) == 0 {
+		return 0, nil
 	}
-	defer CloseOrWarn(insertQuery)
 
-	for item := range logCh {
-		if err := insertLogRecord(insertQuery, item); err != nil {
-			log.Errorf("Can not insert data: %s", err)
+	if err := archiveLogRecords(archiveDir, items); err != nil {
+		return 0, err
+	}
+
+	// The records matching the condition between the first and the last archived one are the archived ones
+	res, err := t.logDb.ExecContext(
+		ctx,
+		fmt.Sprintf(`DELETE FROM LogRecords WHERE Id >= ? AND Id <= ? AND %s`, cond),
+		append([]interface{}{items[0].Id, items[len(items)-1].Id}, args...)...,
+	)
+	if err != nil {
+		return 0, errors.Join(errors.New("unable to delete archived log records"), err)
+	}
+	return res.RowsAffected()
+}
+
+// trimLogRecordsToSize deletes the oldest records until log.db with its WAL fits into maxSize.
+// The rows take only a part of the freed pages with the indexes, so the first batch is sized by the average row size
+// for a half of the excess, and the next ones by the bytes the previous batch has freed, so about the excess is deleted.
+// Freed pages are reused by new records, so the DB file stops growing but doesn't shrink.
+func (t *LogDb) trimLogRecordsToSize(maxSize int64, archiveDir string) (int64, error) {
+	recordSize, err := t.logRecordSize()
+	if err != nil {
+		return 0, err
+	}
+	size, err := t.LogDbSize()
+	if errors.Is(err, ErrWalInUse) {
+		log.Warnf("log.db size cap is skipped till the next vacuum: %s", err)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	limit := (size-maxSize)/2/recordSize + 1
+	for size > maxSize {
+		deleted, err := t.deleteLogRecords("1", nil, min(limit, VacuumBatchSize), archiveDir)
+		total += deleted
+		if err != nil {
+			return total, errors.Join(errors.New("unable to trim log records"), err)
+		}
+		if deleted == 0 {
+			log.Warnf("log.db size %d is above the cap %d without log records", size, maxSize)
+			return total, nil
+		}
+
+		newSize, err := t.LogDbSize()
+		if errors.Is(err, ErrWalInUse) {
+			log.Warnf("log.db size cap is skipped till the next vacuum: %s", err)
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+		if newSize < size {
+			recordSize = max((size-newSize)/deleted, 1)
+		} else {
+			// Pages are freed only when all their records are deleted
+			recordSize = max(recordSize/2, 1)
 		}
+		size = newSize
+		limit = (size - maxSize + recordSize - 1) / recordSize
 	}
+	return total, nil
 }
 
-func (t *LogDb) GetCached(cacheKey string, ttl time.Duration, getter func() (string, error)) (string, error) {
+// ErrWalInUse means readers keep the WAL from being checkpointed, so the DB size isn't known yet
+var ErrWalInUse = errors.New("log.db WAL is in use")
+
+// LogDbSize is the size of the used pages of log.db and of its WAL file.
+// The WAL is checkpointed first, and the size is unknown while readers keep it from being truncated.
+func (t *LogDb) LogDbSize() (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
-	var tx *sqlx.Tx
-	var err error
-	var _ interface{}
+	var checkpoint struct {
+		Busy         int `db:"busy"`
+		Log          int `db:"log"`
+		Checkpointed int `db:"checkpointed"`
+	}
+	if err := t.logDb.GetContext(ctx, &checkpoint, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return 0, errors.Join(errors.New("unable to checkpoint log.db WAL"), err)
+	}
+	if checkpoint.Busy != 0 {
+		return 0, ErrWalInUse
+	}
 
-	if tx, err = t.cacheDb.BeginTxx(ctx, &sql.TxOptions{}); err != nil {
-		return "", errors.Join(errors.New("unable to start CacheData transaction"), err)
+	var size int64
+	err := t.logDb.GetContext(
+		ctx,
+		&size,
+		`SELECT (page_count - freelist_count) * page_size FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`,
+	)
+	if err != nil {
+		return 0, errors.Join(errors.New("unable to get log.db size"), err)
 	}
 
-	now := time.Now().Unix()
-	newExpiresTs := now + int64(ttl/time.Second)
+	walStat, err := os.Stat(path.Join(t.dbDir, "log.db-wal"))
+	if err == nil {
+		size += walStat.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, errors.Join(errors.New("unable to get log.db WAL size"), err)
+	}
+	return size, nil
+}
+
+// logRecordSize is the average size in bytes of the column values of the latest LogRecordsSizeSample records,
+// the SQLite driver is built without dbstat to measure tables exactly
+func (t *LogDb) logRecordSize() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
 
-	curRes := struct {
-		Value     string `db:"Value"`
-		ExpiresTs int64  `db:"ExpiresTs"`
-	}{}
-	err = tx.GetContext(ctx, &curRes, "SELECT Value, ExpiresTs FROM CacheData WHERE Key == ? AND ExpiresTs > ? LIMIT 1", cacheKey, now)
+	var columns []string
+	if err := t.logDb.SelectContext(ctx, &columns, `SELECT name FROM pragma_table_info("LogRecords")`); err != nil {
+		return 0, errors.Join(errors.New("unable to get LogRecords columns"), err)
+	}
+	var sizeExprs []string
+	for _, column := range columns {
+		sizeExprs = append(sizeExprs, fmt.Sprintf(`IFNULL(LENGTH(CAST(%s AS BLOB)), 0)`, column))
+	}
 
-	value := curRes.Value
-	hasData := true
+	var size int64
+	err := t.logDb.GetContext(
+		ctx,
+		&size,
+		fmt.Sprintf(
+			`SELECT IFNULL((SUM(%s) + COUNT(*) - 1) / COUNT(*), 1) FROM (SELECT * FROM LogRecords ORDER BY Id DESC LIMIT ?)`,
+			strings.Join(sizeExprs, " + "),
+		),
+		LogRecordsSizeSample,
+	)
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			WarnIfErr(tx.Rollback())
-			return "", errors.Join(errors.New("unable to get CacheData item"), err)
-		}
-		hasData = false
+		return 0, errors.Join(errors.New("unable to get LogRecords size"), err)
+	}
+	return size, nil
+}
+
+// WriteRecordsFromChannel stores records in transactions bounded by BatchSize and FlushInterval
+// until the channel is closed. Source positions are saved after every batch.
+// It's not bound to a context: on shutdown everything buffered in the channel is persisted.
+func (t *LogDb) WriteRecordsFromChannel(logCh <-chan *LogLineData, params LogWriterParams) {
+	log.Tracef("Executing WriteRecordsFromChannel(logCh, %+v)", params)
+	defer log.Infoln("WriteRecordsFromChannel is finished")
+
+	if params.BatchSize <= 0 {
+		params.BatchSize = 500
 	}
+	if params.FlushInterval <= 0 {
+		params.FlushInterval = 200 * time.Millisecond
+	}
+
+	t.writerStatsLock.Lock()
+	t.writerStats = LogWriterStats{StartTime: time.Now()}
+	t.writerStatsLock.Unlock()
 
-	commitTx := func() error {
-		if err = tx.Commit(); err != nil {
-			return errors.Join(errors.New("unable to commit CacheData transaction"), err)
+	batch := make([]*LogLineData, 0, params.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
 		}
-		return nil
+		t.writeBatch(batch, len(logCh))
+		batch = batch[:0]
 	}
 
-	if hasData {
-		if _, err = tx.ExecContext(ctx, "UPDATE CacheData SET ExpiresTs = ? WHERE Key == ?", newExpiresTs, cacheKey); err != nil {
-			WarnIfErr(tx.Rollback())
-			return "", errors.Join(errors.New("unable to start CacheData update"), err)
+	ticker := time.NewTicker(params.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item, ok := <-logCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= params.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
 		}
-		if err = commitTx(); err != nil {
-			WarnIfErr(tx.Rollback())
-			return "", err
+	}
+}
+
+// WriterStats returns a snapshot of WriteRecordsFromChannel stats
+func (t *LogDb) WriterStats() LogWriterStats {
+	t.writerStatsLock.Lock()
+	defer t.writerStatsLock.Unlock()
+	return t.writerStats
+}
+
+func (t *LogDb) writeBatch(batch []*LogLineData, queueLen int) {
+	startTime := time.Now()
+
+	handled := batch
+	duplicates, err := t.InsertLogRecords(batch)
+	if err != nil {
+		log.Errorf("Can not insert batch of %d records, inserting one by one: %s", len(batch), err)
+		handled, duplicates = nil, 0
+		for _, item := range batch {
+			itemDuplicates, err := t.InsertLogRecords([]*LogLineData{item})
+			if err != nil {
+				log.Errorf("Can not insert data: %s", err)
+				continue
+			}
+			duplicates += itemDuplicates
+			handled = append(handled, item)
 		}
-		return value, nil
 	}
 
-	if value, err = getter(); err != nil {
-		WarnIfErr(tx.Rollback())
-		return "", errors.Join(errors.New("unable to get new value"), err)
+	states := make(map[string]interface{})
+	for _, item := range handled {
+		states[SourceStateKey(item.Source, "LastLogTime")] = formatStateTime(item.LogTime)
+		if item.SourceStateKey != "" {
+			states[item.SourceStateKey] = item.SourceState
+		}
+	}
+	if err := t.SetKvRecords(states); err != nil {
+		log.Errorf("Can not save log source state: %s", err)
 	}
 
-	if _, err = tx.ExecContext(ctx, "REPLACE INTO CacheData (Key, Value, ExpiresTs) VALUES (?, ?, ?)", cacheKey, value, newExpiresTs); err != nil {
-		WarnIfErr(tx.Rollback())
-		return "", errors.Join(errors.New("unable to set new value to DB"), err)
+	t.writerStatsLock.Lock()
+	defer t.writerStatsLock.Unlock()
+	t.writerStats.Records += int64(len(handled) - duplicates)
+	t.writerStats.Duplicates += int64(duplicates)
+	t.writerStats.FailedRecords += int64(len(batch) - len(handled))
+	t.writerStats.Batches++
+	t.writerStats.LastBatchSize = len(batch)
+	t.writerStats.LastBatchDuration = time.Since(startTime)
+	t.writerStats.QueueLen = queueLen
+	if len(handled) > 0 {
+		t.writerStats.Lag = time.Since(handled[len(handled)-1].LogTime)
 	}
+}
 
-	if err = commitTx(); err != nil {
-		WarnIfErr(tx.Rollback())
-		return "", err
-	}
-
-	return value, nil
-}
-
-func (t *LogDb) initSchema() error {
-	var err error
-	err = t.execInitQueries(
-		t.logDb,
-		[]string{
-			`CREATE TABLE IF NOT EXISTS LogRecords (
-				Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-				Ts INTEGER NOT NULL,
-				LogLineType TEXT NOT NULL,
-				LogLine TEXT NOT NULL,
-				LogTime INTEGER NOT NULL,
-				IsError INTEGER NOT NULL,
-				HasRequestInfo INTEGER NOT NULL,
-				Host TEXT NOT NULL,
-				Pid INTEGER NOT NULL,
-				FileName TEXT NOT NULL,
-				FileLine TEXT NOT NULL,
-				SrcIp TEXT NOT NULL,
-				DestIp TEXT NOT NULL,
-				DestPort INTEGER NOT NULL,
-				Username TEXT NOT NULL,
-				Proto TEXT NOT NULL,
-				Method TEXT NOT NULL,
-				Url TEXT NOT NULL,
-				Status INTEGER NOT NULL,
-				ErrorMessage TEXT NOT NULL
-			)`,
-			`CREATE INDEX IF NOT EXISTS Id_LogLineType ON LogRecords (Id, LogLineType)`,
-			`CREATE INDEX IF NOT EXISTS Ts ON LogRecords (Ts)`,
-		},
-	)
+// InsertLogRecords inserts records in one transaction.
+// Only the records that aren't newer than the latest stored record of their source can be re-read,
+// they are skipped when their fingerprint is stored already, and the number of skipped records is returned.
+// Records without a fingerprint get it here, see RecordFingerprinter.
+func (t *LogDb) InsertLogRecords(items []*LogLineData) (int, error) {
+	log.Tracef("Executing InsertLogRecords(%d items)", len(items))
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	tx, err := t.logDb.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
-		return err
+		return 0, errors.Join(errors.New("unable to start InsertLogRecords transaction"), err)
 	}
 
-	err = t.execInitQueries(
-		t.kvDb,
-		[]string{
-			`CREATE TABLE IF NOT EXISTS KvData (
-				Name TEXT NOT NULL PRIMARY KEY,
-				Value TEXT NOT NULL
-			)`,
-			`REPLACE INTO KvData (Name, Value) VALUES ("SchemaVersion", "2")`,
-		},
-	)
+	insertQuery, err := tx.PrepareNamedContext(ctx, logRecordsInsertQuery)
 	if err != nil {
-		return err
+		WarnIfErr(tx.Rollback())
+		return 0, errors.Join(errors.New("unable to prepare insert query in InsertLogRecords"), err)
 	}
+	defer CloseOrWarn(insertQuery)
 
-	err = t.execInitQueries(
-		t.cacheDb,
-		[]string{
-			`CREATE TABLE IF NOT EXISTS CacheData (
-				Key TEXT NOT NULL PRIMARY KEY,
-				Value TEXT NOT NULL,
-				ExpiresTs INTEGER NOT NULL
-			)`,
-			`CREATE INDEX IF NOT EXISTS ExpiresTs ON CacheData (ExpiresTs)`,
-			`CREATE INDEX IF NOT EXISTS Key_ExpiresTs ON CacheData (Key, ExpiresTs)`,
-		},
-	)
+	existsQuery, err := tx.PreparexContext(ctx, `SELECT EXISTS (SELECT 1 FROM LogRecords WHERE Fingerprint == ?)`)
 	if err != nil {
-		return err
+		WarnIfErr(tx.Rollback())
+		return 0, errors.Join(errors.New("unable to prepare fingerprint query in InsertLogRecords"), err)
 	}
+	defer CloseOrWarn(existsQuery)
+
+	duplicates := 0
+	fingerprinter := NewRecordFingerprinter()
+	lastLogTimes := make(map[string]int64)
+	for _, item := range items {
+		if item.Fingerprint == "" {
+			item.Fingerprint = fingerprinter.Fingerprint(item)
+		}
+		logTimeUs := item.LogTime.UnixMicro()
+
+		lastLogTime, ok := lastLogTimes[item.Source]
+		if !ok {
+			err := tx.GetContext(ctx, &lastLogTime, `SELECT IFNULL(MAX(LogTimeUs), 0) FROM LogRecords WHERE Source == ?`, item.Source)
+			if err != nil {
+				WarnIfErr(tx.Rollback())
+				return 0, errors.Join(errors.New("unable to get last log time in InsertLogRecords"), err)
+			}
+		}
+		lastLogTimes[item.Source] = max(lastLogTime, logTimeUs)
 
-	return nil
-}
+		if logTimeUs <= lastLogTime {
+			var exists bool
+			if err := existsQuery.GetContext(ctx, &exists, item.Fingerprint); err != nil {
+				WarnIfErr(tx.Rollback())
+				return 0, errors.Join(errors.New("unable to check fingerprint in InsertLogRecords"), err)
+			}
+			if exists {
+				log.Tracef("Skipping duplicate record %s: %s", item.Fingerprint, item.LogLine)
+				duplicates++
+				continue
+			}
+		}
 
-func (t *LogDb) execInitQueries(db *sqlx.DB, initQueries []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
-	defer cancel()
+		recordId, err := insertLogRecord(insertQuery, item)
+		if err != nil {
+			WarnIfErr(tx.Rollback())
+			return 0, errors.Join(errors.New("unable to insert record in InsertLogRecords"), err)
+		}
 
-	for _, query := range initQueries {
-		if _, err := db.ExecContext(ctx, query); err != nil {
-			return errors.Join(fmt.Errorf("unable to init schema for DB \"%+v\", query %s", db, query), err)
+		if err := correlateProxyRequest(tx, item, recordId); err != nil {
+			WarnIfErr(tx.Rollback())
+			return 0, errors.Join(errors.New("unable to correlate request in InsertLogRecords"), err)
 		}
 	}
-	return nil
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Join(errors.New("unable to commit InsertLogRecords transaction"), err)
+	}
+	return duplicates, nil
 }
 
-func (t *LogDb) checkSchemaVersion() error {
-	version, err := t.GetKvIntRecord("SchemaVersion")
+// formatStateTime formats times of the resume state in UTC with sub-second precision
+func formatStateTime(tm time.Time) string {
+	return tm.UTC().Format(time.RFC3339Nano)
+}
+
+func setTimes(val *BasicGroupReportData) {
+	val.FirstTime = time.Unix(val.FirstTs, 0).UTC()
+	val.LastTime = time.Unix(val.LastTs, 0).UTC()
+}
+
+func sourcesCondition(sources []string) (string, []interface{}) {
+	if len(sources) == 0 {
+		return "", nil
+	}
+
+	query, args, err := sqlx.In(`AND Source IN (?)`, sources)
 	if err != nil {
-		return err
+		log.Panicf("unable to build sources condition: %s", err)
+	}
+	return query, args
+}
+
+// RecordFingerprinter identifies log lines, so the same line read again after a restart can be detected.
+// Lines with a source position like the journal cursor or the file offset are identified by it with the line,
+// as the file offsets are reused when the file is truncated by copytruncate.
+// Other lines are identified by host, PID, log time and line with the number of the same lines before them
+// in the stream, so repeated lines of one second are different records.
+// One fingerprinter is used for one stream of lines, and a new one is used when the stream is restarted.
+type RecordFingerprinter struct {
+	occurrences   map[string]lineOccurrences
+	lastLogTimeUs int64
+	sweepTimeUs   int64
+}
+
+type lineOccurrences struct {
+	Count     int
+	LogTimeUs int64
+}
+
+func NewRecordFingerprinter() *RecordFingerprinter {
+	return &RecordFingerprinter{occurrences: make(map[string]lineOccurrences)}
+}
+
+func (t *RecordFingerprinter) Fingerprint(item *LogLineData) string {
+	if item.SourceState != "" {
+		return logRecordFingerprint("position", item.SourceStateKey, item.SourceState+"\x00"+item.LogLine)
 	}
 
-	if version == 1 {
-		log.Fatalf("Version %d is not supported. Please backup the old DB and delete ir", version)
-	} else if version != 2 {
-		log.Fatalf("Version is incorrect: %d", version)
+	logTimeUs := item.LogTime.UnixMicro()
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%s", item.Host, item.Pid, logTimeUs, item.LogLine)
+	occurrences := t.occurrences[key]
+	t.occurrences[key] = lineOccurrences{Count: occurrences.Count + 1, LogTimeUs: logTimeUs}
+
+	t.lastLogTimeUs = max(t.lastLogTimeUs, logTimeUs)
+	windowUs := FingerprintOccurrencesWindow.Microseconds()
+	if t.lastLogTimeUs-t.sweepTimeUs > windowUs {
+		for key, val := range t.occurrences {
+			if val.LogTimeUs < t.lastLogTimeUs-windowUs {
+				delete(t.occurrences, key)
+			}
+		}
+		t.sweepTimeUs = t.lastLogTimeUs
 	}
 
-	return nil
+	return logRecordFingerprint("line", key, strconv.Itoa(occurrences.Count))
 }
 
-func setTimes(val *BasicGroupReportData) {
-	val.FirstTime = time.Unix(int64(val.FirstTs), 0).UTC().Format(time.RFC3339)
-	val.LastTime = time.Unix(int64(val.LastTs), 0).UTC().Format(time.RFC3339)
+func logRecordFingerprint(kind string, key string, value string) string {
+	hash := fnv.New128a()
+	_, _ = fmt.Fprintf(hash, "%s\x00%s\x00%s", kind, key, value)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-func insertLogRecord(insertQuery *sqlx.NamedStmt, item *LogLineData) error {
+func insertLogRecord(insertQuery *sqlx.NamedStmt, item *LogLineData) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
 	defer cancel()
 
-	_, err := insertQuery.ExecContext(ctx, LogLineDataInsertData{
+	res, err := insertQuery.ExecContext(ctx, LogLineDataInsertData{
 		LogLineData: item,
 		Ts:          time.Now().Unix(),
 		LogTime:     item.LogTime.Unix(),
+		LogTimeUs:   item.LogTime.UnixMicro(),
 		LogLineType: item.LogLineType.String(),
 	})
-	return err
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// correlateProxyRequest joins the Request: line and the HTTP status line of a request into one ProxyRequests row.
+// The status line is matched to the latest request without a status from the same process, source IP and port.
+func correlateProxyRequest(tx *sqlx.Tx, item *LogLineData, recordId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	logTime := item.LogTime.Unix()
+	switch item.LogLineType {
+	case LogLineTypeProxyRequest:
+		_, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO ProxyRequests 
+			    (Ts, Source, Instance, Host, Pid, SrcIp, SrcPort, Username, DestIp, DestPort, Proto, Method, Url, StartTime, RequestRecordId)
+			VALUES 
+			    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			now, item.Source, item.Instance, item.Host, item.Pid, item.SrcIp, item.SrcPort, item.Username,
+			item.DestIp, item.DestPort, item.Proto, item.Method, item.Url, logTime, recordId,
+		)
+		return err
+	case LogLineTypeProxyRequestHttpInfo:
+		res, err := tx.ExecContext(
+			ctx,
+			`UPDATE ProxyRequests SET Status = ?, EndTime = ?, HttpInfoRecordId = ?
+			WHERE Id = (
+				SELECT Id FROM ProxyRequests
+				WHERE 
+				    Source == ? AND Host == ? AND Pid == ? AND SrcIp == ? AND SrcPort == ? 
+				    AND HttpInfoRecordId == 0 AND StartTime BETWEEN ? AND ?
+				ORDER BY StartTime DESC, Id DESC
+				LIMIT 1
+			)`,
+			item.Status, logTime, recordId,
+			item.Source, item.Host, item.Pid, item.SrcIp, item.SrcPort,
+			logTime-int64(RequestCorrelationWindow/time.Second), logTime,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, err := res.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO ProxyRequests 
+			    (Ts, Source, Instance, Host, Pid, SrcIp, SrcPort, Method, Url, Status, StartTime, EndTime, HttpInfoRecordId)
+			VALUES 
+			    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			now, item.Source, item.Instance, item.Host, item.Pid, item.SrcIp, item.SrcPort,
+			item.Method, item.Url, item.Status, logTime, logTime, recordId,
+		)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRecordsFromChannel(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	logCh := make(chan *LogLineData, 10)
+	logTime := time.Date(2024, time.June, 18, 0, 7, 26, 0, time.Local)
+	line := readFileToString("test/data/log-line-request.txt")
+	// The same line at different positions is stored twice, the line at a stored position is read again
+	for i, state := range []string{"a", "b", "c", "d", "e", "e"} {
+		data := Must1(ParseLogLine(strings.Replace(line, ":64154", fmt.Sprintf(":%d", 64150+min(i, 3)), 1)))
+		data.Source = "test"
+		data.SourceStateKey = SourceStateKey("test", "TestState")
+		data.SourceState = state
+		logCh <- data
+	}
+	close(logCh)
+
+	db.WriteRecordsFromChannel(logCh, LogWriterParams{BatchSize: 2, FlushInterval: time.Hour})
+
+	var count int
+	Must0(db.logDb.Get(&count, `SELECT COUNT(*) FROM LogRecords WHERE Source = "test"`))
+	assert.Equal(t, 5, count)
+	assert.Equal(t, "e", Must1(db.GetKvStrRecord("Source:test:TestState")))
+	assert.Equal(t, logTime.UTC(), Must1(db.GetLastHandledTime("test")))
+
+	var logTimeUs int64
+	Must0(db.logDb.Get(&logTimeUs, `SELECT MAX(LogTimeUs) FROM LogRecords WHERE Source = "test"`))
+	assert.Equal(t, logTime.UnixMicro(), logTimeUs)
+
+	stats := db.WriterStats()
+	assert.Equal(t, int64(5), stats.Records)
+	assert.Equal(t, int64(1), stats.Duplicates)
+	assert.Equal(t, int64(3), stats.Batches)
+	assert.Equal(t, 2, stats.LastBatchSize)
+}
+
+func TestWriteRecordsFromChannelFlushInterval(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	logCh := make(chan *LogLineData, 10)
+	finished := make(chan struct{})
+	go func() {
+		db.WriteRecordsFromChannel(logCh, LogWriterParams{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+		close(finished)
+	}()
+
+	logCh <- Must1(ParseLogLine(readFileToString("test/data/log-line-request.txt")))
+	assert.Eventually(t, func() bool {
+		var count int
+		Must0(db.logDb.Get(&count, `SELECT COUNT(*) FROM LogRecords`))
+		return count == 1
+	}, time.Second, 10*time.Millisecond)
+
+	close(logCh)
+	<-finished
+	assert.Equal(t, int64(1), db.WriterStats().Batches)
+}
+
+func TestInsertLogRecordsDuplicates(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	line := readFileToString("test/data/log-line-request.txt")
+	otherLine := strings.Replace(line, ":64154", ":64155", 1)
+	newBatch := func(lines ...string) []*LogLineData {
+		var res []*LogLineData
+		for _, line := range lines {
+			res = append(res, Must1(ParseLogLine(line)))
+		}
+		return res
+	}
+
+	assert.Equal(t, 0, Must1(db.InsertLogRecords(newBatch(line))))
+	// Lines repeated in one second are different records
+	assert.Equal(t, 1, Must1(db.InsertLogRecords(newBatch(line, otherLine, otherLine))))
+	assert.Equal(t, 3, Must1(db.InsertLogRecords(newBatch(line, otherLine, otherLine))))
+
+	// Newer lines aren't read again, so they aren't checked
+	newerLine := strings.Replace(line, "00:07:26", "00:07:27", 2)
+	assert.Equal(t, 0, Must1(db.InsertLogRecords(newBatch(newerLine, newerLine))))
+
+	var count int
+	Must0(db.logDb.Get(&count, `SELECT COUNT(*) FROM LogRecords`))
+	assert.Equal(t, 5, count)
+}
+
+func TestInsertLogRecordsCorrelatesRequests(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	_, err := db.InsertLogRecords([]*LogLineData{
+		parseProxyRecord(26, `Request: 1.2.3.4:5000 => 2.56.204.64:443 "bob" HTTP/1.1 GET http://example.com/a`),
+		parseProxyRecord(27, `Request: 1.2.3.4:5001 => 2.56.204.64:443 "alice" HTTP/1.1 GET http://example.com/b`),
+		parseProxyRecord(28, `1.2.3.4:5000 GET http://example.com/a 200 OK`),
+		parseProxyRecord(29, `Request: 1.2.3.4:5000 => 2.56.204.64:443 "bob" HTTP/1.1 GET http://example.com/c`),
+		parseProxyRecord(30, `1.2.3.4:5000 GET http://example.com/c 404 Not Found`),
+		parseProxyRecord(31, `1.2.3.4:5002 GET http://example.com/d 502 Bad Gateway`),
+	})
+	assert.NoError(t, err)
+
+	var requests []struct {
+		Username string `db:"Username"`
+		Url      string `db:"Url"`
+		Status   int    `db:"Status"`
+	}
+	Must0(db.logDb.Select(&requests, `SELECT Username, Url, Status FROM ProxyRequests ORDER BY Id`))
+	assert.Equal(t, []struct {
+		Username string `db:"Username"`
+		Url      string `db:"Url"`
+		Status   int    `db:"Status"`
+	}{
+		{"bob", "http://example.com/a", 200},
+		{"alice", "http://example.com/b", 0},
+		{"bob", "http://example.com/c", 404},
+		{"", "http://example.com/d", 502},
+	}, requests)
+
+	statuses := Must1(db.GetUserStatusesReportData(0, nil))
+	assert.Len(t, statuses, 3)
+	assert.Equal(t, "<empty>", statuses[0].Username)
+	assert.Equal(t, "bob", statuses[1].Username)
+}
+
+func TestAuthFailuresAreNotRequests(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	authParser := Must1(NewLogParser(LogParserParams{ProxyAuth: true}))
+	prefix := "Jun 18 00:07:%02d p487-2-am.jethelix.ru dumbproxy[82403]: %s   : 2024/06/18 00:07:%02d handler.go:138: %s"
+	var items []*LogLineData
+	for i, record := range [][2]string{
+		{"PROXY", `INFO     Request: 1.2.3.4:5000 => 2.56.204.64:443 "bob" HTTP/1.1 GET http://example.com/a`},
+		{"PROXY", `INFO     Request: 1.2.3.4:5001 => 2.56.204.64:443 "" HTTP/1.1 GET http://example.com/b`},
+		{"AUTH", `ERROR    authentication failed for user "eve" from 5.6.7.8:6000: bad password`},
+	} {
+		items = append(items, Must1(authParser.ParseLogLine(fmt.Sprintf(prefix, 26+i, record[0], 26+i, record[1]))))
+	}
+	Must1(db.InsertLogRecords(items))
+
+	users := Must1(db.GetUsersReportData(0, nil))
+	assert.Len(t, users, 1)
+	assert.Equal(t, "bob", users[0].Username)
+	assert.Equal(t, 1, users[0].Reqs)
+
+	var requests int
+	Must0(db.logDb.Get(&requests, `SELECT COUNT(*) FROM ProxyRequests`))
+	assert.Equal(t, 1, requests)
+
+	failures := Must1(db.GetAuthFailuresReportData(0, nil))
+	assert.Len(t, failures, 2)
+	assert.ElementsMatch(t, []string{"<empty>/1.2.3.4/rejected", "eve/5.6.7.8/bad password"}, []string{
+		failures[0].Username + "/" + failures[0].SrcIp + "/" + failures[0].Reasons,
+		failures[1].Username + "/" + failures[1].SrcIp + "/" + failures[1].Reasons,
+	})
+}
+
+func TestUnknownLinesReportData(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	var items []*LogLineData
+	for _, line := range []string{
+		readFileToString("test/data/log-line-request.txt"),
+		"Jun 18 00:07:26 p487-2-am.jethelix.ru dumbproxy[82403]: garbage from 1.2.3.4:5555",
+		"Jun 18 00:07:27 p487-2-am.jethelix.ru dumbproxy[82403]: garbage from 5.6.7.8:6666",
+		"Jun 18 00:07:28 p487-2-am.jethelix.ru sshd[100]: Accepted publickey",
+	} {
+		items = append(items, Must1(ParseLogLine(line)))
+	}
+	items = append(items, NewParseFailureLogLine("strange line 42", errors.New("test error")))
+	Must1(db.InsertLogRecords(items))
+
+	unknownLines := Must1(db.GetUnknownLinesReportData(0, nil))
+	assert.Len(t, unknownLines, 2)
+	assert.Equal(t, "garbage from <ip>:<num>", unknownLines[0].LineTemplate)
+	assert.Equal(t, 2, unknownLines[0].Reqs)
+	assert.Equal(t, "invalid record format", unknownLines[0].Reasons)
+	assert.Equal(t, "strange line <num>", unknownLines[1].LineTemplate)
+
+	coverage := Must1(db.GetParserCoverageReportData(0, nil))
+	assert.Equal(t, 4, coverage.Lines)
+	assert.Equal(t, 3, coverage.Unknown)
+	assert.Equal(t, 25.0, coverage.Coverage())
+}
+
+func TestLogRecordsVacuumCleanRetentionRules(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	isError := true
+	rules := []RetentionRule{
+		{LogLineType: "LogLineTypeOtherUnit", MaxAge: "1h"},
+		{IsError: &isError, MaxAge: "720h"},
+	}
+	Must0(ValidateRetentionRules(rules))
+	params := RetentionParams{MaxAge: 48 * time.Hour, Rules: rules}
+
+	Must1(db.InsertLogRecords([]*LogLineData{
+		Must1(ParseLogLine(readFileToString("test/data/log-line-request.txt"))),
+		Must1(ParseLogLine(readFileToString("test/data/log-line-request-error.txt"))),
+		Must1(ParseLogLine("Jun 18 00:07:26 p487-2-am.jethelix.ru sshd[1234]: Accepted publickey for root")),
+	}))
+	countTypes := func() []string {
+		var types []string
+		Must0(db.logDb.Select(&types, `SELECT LogLineType FROM LogRecords ORDER BY Id`))
+		return types
+	}
+
+	Must1(db.logDb.Exec(`UPDATE LogRecords SET Ts = ?`, time.Now().Add(-2*time.Hour).Unix()))
+	assert.Equal(t, int64(1), Must1(db.LogRecordsVacuumClean(params)))
+	assert.Equal(t, []string{"LogLineTypeProxyRequest", "LogLineTypeProxyRequestError"}, countTypes())
+
+	Must1(db.logDb.Exec(`UPDATE LogRecords SET Ts = ?`, time.Now().Add(-100*time.Hour).Unix()))
+	assert.Equal(t, int64(1), Must1(db.LogRecordsVacuumClean(params)))
+	assert.Equal(t, []string{"LogLineTypeProxyRequestError"}, countTypes())
+
+	var requests int
+	Must0(db.logDb.Get(&requests, `SELECT COUNT(*) FROM ProxyRequests`))
+	assert.Equal(t, 0, requests)
+
+	// The size cap trims records regardless of their retention
+	assert.Equal(t, int64(1), Must1(db.LogRecordsVacuumClean(RetentionParams{MaxAge: params.MaxAge, Rules: rules, MaxDbSize: 1})))
+	assert.Empty(t, countTypes())
+
+	assert.Error(t, ValidateRetentionRules([]RetentionRule{{LogLineType: "LogLineTypeNope", MaxAge: "1h"}}))
+	assert.Error(t, ValidateRetentionRules([]RetentionRule{{MaxAge: "30d"}}))
+}
+
+func TestTrimLogRecordsToSize(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	var items []*LogLineData
+	for i := 0; i < 2000; i++ {
+		items = append(items, parseProxyRecord(i%60, fmt.Sprintf(`Request: 1.2.3.4:%d => 2.56.204.64:443 "bob" HTTP/1.1 GET http://example.com/%d`, 5000+i, i)))
+	}
+	Must1(db.InsertLogRecords(items))
+	size := Must1(db.LogDbSize())
+	assert.Equal(t, int64(0), Must1(db.trimLogRecordsToSize(size, "")))
+
+	// The used pages count, the free ones don't
+	maxSize := size * 3 / 4
+	deleted := Must1(db.trimLogRecordsToSize(maxSize, ""))
+	assert.LessOrEqual(t, Must1(db.LogDbSize()), maxSize)
+	assert.Greater(t, deleted, int64(250))
+	assert.Less(t, deleted, int64(1000))
+
+	var firstId int64
+	Must0(db.logDb.Get(&firstId, `SELECT MIN(Id) FROM LogRecords`))
+	assert.Equal(t, deleted+1, firstId)
+
+	// The other tables can't be trimmed, so all the records are deleted
+	assert.Equal(t, 2000-deleted, Must1(db.trimLogRecordsToSize(1, "")))
+}
+
+// parseProxyRecord parses the INFO record of the PROXY logger written at 2024/06/18 00:07:sec
+func parseProxyRecord(sec int, record string) *LogLineData {
+	prefix := "Jun 18 00:07:%02d p487-2-am.jethelix.ru dumbproxy[82403]: PROXY   : 2024/06/18 00:07:%02d handler.go:138: INFO     "
+	return Must1(ParseLogLine(fmt.Sprintf(prefix, sec, sec) + record))
+}
@@ -2,17 +2,43 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oriser/regroup"
-	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
 )
 
-var systemDLogRe = regroup.MustCompile("^(?P<month>\\w+)\\s+(?P<day>\\d+)\\s+(?P<hour>\\d+):(?P<minute>\\d+):(?P<sec>\\d+)\\s+(?P<host>\\S+)\\s+(?P<unit>[\\w.-]+)\\[(?P<pid>\\d+)]:\\s+(?P<logRecord>.+)$")
-var dumbProxyLogRe = regroup.MustCompile("^(?P<logger>\\w+)\\s+:\\s+(?P<year>\\d+)/(?P<month>\\d+)/(?P<day>\\d+)\\s+(?P<hour>\\d+):(?P<minute>\\d+):(?P<sec>\\d+)\\s+(?P<fileName>[^:]+):(?P<line>\\d+):(?:\\s+(?P<levelName>[A-Z]+))?\\s+(?P<logRecord>.+)$")
-var dumbProxyRequestLineRe = regroup.MustCompile("^Request:\\s+(?P<srcIp>\\S+):\\d+\\s+=>\\s+(?P<destIp>\\S+):(?P<destPort>\\d+)\\s+\"(?P<username>[^\"]*)\"\\s+(?P<proto>\\S+)\\s+(?P<method>[A-Z]+)\\s+(?P<url>.+)$")
+// DefaultLogParser returns the parser with the built-in rules
+var DefaultLogParser = sync.OnceValue(func() *LogParser {
+	return Must1(NewLogParser(LogParserParams{}))
+})
+
+type LogParserParams struct {
+	// RulesPath is a JSON file with LogParserRules, empty means the built-in rules
+	RulesPath string
+	// Units overrides the unit patterns of the rules
+	Units []string
+	// Location is the timezone of the log times without an offset, time.Local by default
+	Location *time.Location
+	// ProxyAuth enables the rules for dumbproxy with required authentication, like requests without a user being auth failures
+	ProxyAuth bool
+}
+
+type LogParser struct {
+	systemDLogRe   *regroup.ReGroup
+	dumbProxyLogRe *regroup.ReGroup
+	units          []*unitPattern
+	rules          []*compiledLogParserRule
+	errorClasses   []*compiledLogErrorClass
+	authClasses    []*compiledLogErrorClass
+	location       *time.Location
+}
 
 type SystemDLogLineRecord struct {
 	Month     string `regroup:"month"`
@@ -25,6 +51,8 @@ type SystemDLogLineRecord struct {
 	Unit      string `regroup:"unit"`
 	Pid       int    `regroup:"pid"`
 	LogRecord string `regroup:"logRecord"`
+	// ExactTime is set when LogTime is taken from a precise source like the journal
+	ExactTime bool
 }
 
 type DumbProxyLogLineRecord struct {
@@ -42,11 +70,20 @@ type DumbProxyLogLineRecord struct {
 	LogRecord string `regroup:"logRecord"`
 }
 
+type LogFormat uint64
+
+const (
+	LogFormatSyslog LogFormat = iota
+	LogFormatJournalJson
+	LogFormatSyslogMessage
+)
+
 type LogLineType uint64
 
 const (
 	LogLineTypeUnmatched LogLineType = iota
 	LogLineTypeOtherUnit
+	// LogLineTypeProxyUnknown is not set anymore, it's kept for the records stored by older versions
 	LogLineTypeProxyUnknown
 
 	LogLineTypeProxyRequest
@@ -56,6 +93,13 @@ const (
 
 	LogLineTypeRuntimeLog
 	LogLineTypeAuthModuleLog
+	LogLineTypeTlsHandshakeError
+	// LogLineTypeParseFailure is a dumbproxy line that no rule matched, ErrorReason tells what failed
+	LogLineTypeParseFailure
+	// LogLineTypeProxyAuthFailure is a request rejected by the proxy auth, it isn't counted as a request
+	LogLineTypeProxyAuthFailure
+
+	logLineTypesEnd
 )
 
 func (t LogLineType) String() string {
@@ -75,14 +119,29 @@ func (t LogLineType) String() string {
 	case LogLineTypeHttpSrvError:
 		return "LogLineTypeHttpSrvError"
 	case LogLineTypeRuntimeLog:
-		return "LogLineTypeHttpSrvError"
+		return "LogLineTypeRuntimeLog"
 	case LogLineTypeAuthModuleLog:
 		return "LogLineTypeAuthModuleLog"
+	case LogLineTypeTlsHandshakeError:
+		return "LogLineTypeTlsHandshakeError"
+	case LogLineTypeParseFailure:
+		return "LogLineTypeParseFailure"
+	case LogLineTypeProxyAuthFailure:
+		return "LogLineTypeProxyAuthFailure"
 	default:
 		return "LogLineType__UNKNOWN"
 	}
 }
 
+func LogLineTypeFromString(name string) (LogLineType, bool) {
+	for lineType := LogLineTypeUnmatched; lineType < logLineTypesEnd; lineType++ {
+		if lineType.String() == name {
+			return lineType, true
+		}
+	}
+	return LogLineTypeUnmatched, false
+}
+
 var monthMap = map[string]time.Month{
 	"Jan": time.January,
 	"Feb": time.February,
@@ -99,6 +158,7 @@ var monthMap = map[string]time.Month{
 }
 
 type LogLineData struct {
+	Source         string `db:"Source"`
 	LogLineType    LogLineType
 	LogLine        string `db:"LogLine"`
 	LogTime        time.Time
@@ -106,151 +166,409 @@ type LogLineData struct {
 	HasRequestInfo bool   `db:"HasRequestInfo"`
 	Host           string `db:"Host"`
 	Pid            int    `db:"Pid"`
+	Instance       string `db:"Instance"`
 	FileName       string `db:"FileName"`
 	FileLine       int    `db:"FileLine"`
 	SrcIp          string `db:"SrcIp"`
+	SrcPort        int    `db:"SrcPort"`
 	DestIp         string `db:"DestIp"`
 	DestPort       int    `db:"DestPort"`
+	// AddrFamily of DestIp is ipv4, ipv6 or name
+	AddrFamily string `db:"AddrFamily"`
+	// UpstreamOp is the failed upstream operation like dial, read or tls
+	UpstreamOp string `db:"UpstreamOp"`
+	// ErrorClass is the normalized cause of the error like refused or timeout
+	ErrorClass string `db:"ErrorClass"`
+	// ErrorReason is the reason from the error message like the TLS handshake failure
+	ErrorReason string `db:"ErrorReason"`
+	// AuthOutcome of the AUTH module events is success or failure
+	AuthOutcome string `db:"AuthOutcome"`
+	// UrlScheme, UrlHost, UrlPort and UrlPath are decomposed from Url, or from DestIp and DestPort without Url.
+	// UrlScheme of CONNECT requests is connect.
+	UrlScheme string `db:"UrlScheme"`
+	UrlHost   string `db:"UrlHost"`
+	UrlPort   int    `db:"UrlPort"`
+	UrlPath   string `db:"UrlPath"`
+	// SiteDomain is the registrable domain of UrlHost like googlevideo.com, or the IP address
+	SiteDomain string `db:"SiteDomain"`
+	// LineTemplate clusters the lines that aren't recognized, see lineTemplate
+	LineTemplate   string `db:"LineTemplate"`
 	Username       string `db:"Username"`
 	Proto          string `db:"Proto"`
 	Method         string `db:"Method"`
 	Url            string `db:"Url"`
 	Status         int    `db:"Status"`
 	ErrorMessage   string `db:"ErrorMessage"`
+	SourceStateKey string `json:"-"`
+	SourceState    string `json:"-"`
+	// Fingerprint identifies the line for skipping it when it's read again, see RecordFingerprinter
+	Fingerprint string `db:"Fingerprint" json:"-"`
 }
 
-type requestLogRecord struct {
-	SrcIp    string `regroup:"srcIp"`
-	DestIp   string `regroup:"destIp"`
-	DestPort int    `regroup:"destPort"`
-	Username string `regroup:"username"`
-	Proto    string `regroup:"proto"`
-	Method   string `regroup:"method"`
-	Url      string `regroup:"url"`
+var ErrorParse = errors.New("parse error")
+
+// DetectLogFormat guesses the format of the line for the inputs that can mix formats like imports
+func DetectLogFormat(logLine string) LogFormat {
+	switch {
+	case strings.HasPrefix(logLine, "{"):
+		return LogFormatJournalJson
+	case strings.HasPrefix(logLine, "<"):
+		return LogFormatSyslogMessage
+	default:
+		return LogFormatSyslog
+	}
 }
 
-var ErrorParse = errors.New("parse error")
+func NewLogParser(params LogParserParams) (*LogParser, error) {
+	rules, err := LoadLogParserRules(params.RulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.Units) > 0 {
+		rules.Units = params.Units
+	}
+
+	res := &LogParser{location: params.Location}
+	if res.location == nil {
+		res.location = time.Local
+	}
+	for _, unit := range rules.Units {
+		pattern, err := compileUnitPattern(unit)
+		if err != nil {
+			return nil, err
+		}
+		res.units = append(res.units, pattern)
+	}
+	if res.systemDLogRe, err = requireRegexGroups(rules.SystemDRegex, SystemDLogLineRecord{}); err != nil {
+		return nil, errors.Join(errors.New("invalid SystemD regex of parser rules"), err)
+	}
+	if res.dumbProxyLogRe, err = requireRegexGroups(rules.RecordRegex, DumbProxyLogLineRecord{}); err != nil {
+		return nil, errors.Join(errors.New("invalid record regex of parser rules"), err)
+	}
+	for _, rule := range rules.Rules {
+		if rule.ProxyAuth && !params.ProxyAuth {
+			continue
+		}
+		compiledRule, err := compileLogParserRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		res.rules = append(res.rules, compiledRule)
+	}
+	for _, errorClass := range rules.ErrorClasses {
+		compiledErrorClass, err := compileLogErrorClass(errorClass)
+		if err != nil {
+			return nil, err
+		}
+		res.errorClasses = append(res.errorClasses, compiledErrorClass)
+	}
+	for _, authClass := range rules.AuthReasonClasses {
+		compiledAuthClass, err := compileLogErrorClass(authClass)
+		if err != nil {
+			return nil, err
+		}
+		res.authClasses = append(res.authClasses, compiledAuthClass)
+	}
+	return res, nil
+}
 
 func ParseLogLine(logLine string) (*LogLineData, error) {
+	return DefaultLogParser().ParseLogLine(logLine)
+}
+
+func ParseLogLineOfFormat(logLine string, format LogFormat) (*LogLineData, error) {
+	return DefaultLogParser().ParseLogLineOfFormat(logLine, format)
+}
+
+func ParseSystemDLogLine(logLine string) (*SystemDLogLineRecord, error) {
+	return DefaultLogParser().ParseSystemDLogLine(logLine)
+}
+
+func ParseDumbProxyLogLine(systemDLogLine string) (*DumbProxyLogLineRecord, error) {
+	return DefaultLogParser().ParseDumbProxyLogLine(systemDLogLine)
+}
+
+// WithLocation returns the parser with the same rules for the log source in another timezone
+func (t *LogParser) WithLocation(location *time.Location) *LogParser {
+	res := *t
+	res.location = location
+	return &res
+}
+
+func (t *LogParser) ParseLogLine(logLine string) (*LogLineData, error) {
+	return t.ParseLogLineOfFormat(logLine, LogFormatSyslog)
+}
+
+func (t *LogParser) ParseLogLineOfFormat(logLine string, format LogFormat) (*LogLineData, error) {
 	res := new(LogLineData)
-	res.LogTime = time.Now()
+	res.LogTime = time.Now().UTC()
 	res.LogLine = logLine
 
-	sysLogRes, err := ParseSystemDLogLine(logLine)
+	var sysLogRes *SystemDLogLineRecord
+	var err error
+	switch format {
+	case LogFormatJournalJson:
+		sysLogRes, err = ParseJournalLogLine(logLine, t.location)
+		if err == nil {
+			res.LogLine = FormatSystemDLogLine(sysLogRes)
+		}
+	case LogFormatSyslogMessage:
+		sysLogRes, err = ParseSyslogMessage(logLine, t.location)
+		if err == nil {
+			res.LogLine = FormatSystemDLogLine(sysLogRes)
+		}
+	default:
+		sysLogRes, err = t.ParseSystemDLogLine(logLine)
+	}
 	if err != nil {
 		if errors.Is(err, ErrorParse) {
 			res.LogLineType = LogLineTypeUnmatched
+			res.LineTemplate = lineTemplate(logLine)
 			return res, nil
 		}
 		return nil, errors.Join(errors.New("SystemD parse error"), err)
 	}
 
-	res.LogTime = sysLogRes.LogTime
+	res.LogTime = sysLogRes.LogTime.UTC()
 	res.Host = sysLogRes.Host
 	res.Pid = sysLogRes.Pid
-	if sysLogRes.Unit != "dumbproxy" {
+	instance, ok := t.matchUnit(sysLogRes.Unit)
+	if !ok {
 		res.LogLineType = LogLineTypeOtherUnit
 		return res, nil
 	}
+	res.Instance = instance
 
-	dumbProxyRes, err := ParseDumbProxyLogLine(sysLogRes.LogRecord)
-	res.LogLineType = LogLineTypeProxyUnknown
+	dumbProxyRes, err := t.ParseDumbProxyLogLine(sysLogRes.LogRecord)
 	if err != nil {
 		if errors.Is(err, ErrorParse) {
+			res.LogLineType = LogLineTypeParseFailure
+			res.ErrorReason = "invalid record format"
+			res.LineTemplate = lineTemplate(sysLogRes.LogRecord)
 			return res, nil
 		}
 		return nil, errors.Join(errors.New("dumbproxy parse error"), err)
 	}
 
-	res.LogLineType = LogLineTypeProxyUnknown
-	res.LogTime = dumbProxyRes.LogTime
+	res.LogLineType = LogLineTypeParseFailure
+	res.ErrorReason = fmt.Sprintf("no rule for %s %s record", dumbProxyRes.Logger, StrDef(dumbProxyRes.LevelName, "unleveled"))
+	if !sysLogRes.ExactTime {
+		res.LogTime = dumbProxyRes.LogTime.UTC()
+	}
 	res.FileName = dumbProxyRes.FileName
 	res.FileLine = dumbProxyRes.FileLine
 
-	switch dumbProxyRes.Logger {
-	case "PROXY":
-		if dumbProxyRes.LevelName == "INFO" {
-			if strings.HasPrefix(dumbProxyRes.LogRecord, "Request: ") {
-				var curData requestLogRecord
-				if err := dumbProxyRequestLineRe.MatchToTarget(dumbProxyRes.LogRecord, &curData); err != nil {
-					return res, nil
-				}
-				res.LogLineType = LogLineTypeProxyRequest
-				res.SrcIp = curData.SrcIp
-				res.DestIp = curData.DestIp
-				res.DestPort = curData.DestPort
-				res.Username = curData.Username
-				res.Proto = curData.Proto
-				res.Method = curData.Method
-				res.Url = curData.Url
-				res.HasRequestInfo = true
-			} else {
-				parts := strings.Split(dumbProxyRes.LogRecord, " ")
-				if len(parts) != 5 {
-					return res, nil
-				}
-				res.LogLineType = LogLineTypeProxyRequestHttpInfo
-				res.SrcIp = parts[0][:strings.LastIndex(parts[0], ":")]
-				res.Method = parts[1]
-				res.Url = parts[2]
-				if res.Status, err = strconv.Atoi(parts[3]); err != nil {
-					log.Errorf("Unable to parse status code: %s", err)
-				}
-				res.HasRequestInfo = true
+	for _, rule := range t.rules {
+		if groups, ok := rule.matchRecord(dumbProxyRes); ok {
+			res.ErrorReason = ""
+			rule.apply(dumbProxyRes, groups, res)
+			if rule.ClassifyError {
+				res.ErrorClass = classifyMessage(t.errorClasses, res.ErrorMessage)
 			}
-		} else {
-			res.IsError = true
-			res.LogLineType = LogLineTypeProxyRequestError
-			res.ErrorMessage = dumbProxyRes.LogRecord
+			if rule.ClassifyAuthReason && (res.IsError || res.AuthOutcome == "failure") {
+				res.ErrorClass = classifyMessage(t.authClasses, StrDef(res.ErrorReason, res.ErrorMessage))
+			}
+			break
 		}
-		break
-	case "HTTPSRV":
-		res.IsError = true
-		res.LogLineType = LogLineTypeHttpSrvError
-		res.ErrorMessage = dumbProxyRes.LogRecord
-		break
-	case "MAIN":
-		res.IsError = dumbProxyRes.LevelName == "ERROR" || dumbProxyRes.LevelName == "CRITICAL"
-		res.LogLineType = LogLineTypeRuntimeLog
-		res.ErrorMessage = dumbProxyRes.LogRecord
-		break
-	case "AUTH":
-		res.IsError = dumbProxyRes.LevelName == "ERROR" || dumbProxyRes.LevelName == "CRITICAL"
-		res.LogLineType = LogLineTypeAuthModuleLog
-		res.ErrorMessage = dumbProxyRes.LogRecord
-		break
+	}
+
+	res.SrcIp = trimAddrBrackets(res.SrcIp)
+	if res.DestIp != "" {
+		res.DestIp = trimAddrBrackets(res.DestIp)
+		res.AddrFamily = addrFamily(res.DestIp)
+	}
+	decomposeUrl(res)
+	if res.LogLineType == LogLineTypeParseFailure {
+		res.LineTemplate = lineTemplate(sysLogRes.LogRecord)
 	}
 
 	return res, nil
 }
 
-func ParseSystemDLogLine(logLine string) (*SystemDLogLineRecord, error) {
+// NewParseFailureLogLine keeps the line that the parser returned an error for, so it's counted in the report
+func NewParseFailureLogLine(logLine string, err error) *LogLineData {
+	return &LogLineData{
+		LogLineType:  LogLineTypeParseFailure,
+		LogLine:      logLine,
+		LogTime:      time.Now().UTC(),
+		ErrorReason:  "parse error",
+		ErrorMessage: err.Error(),
+		LineTemplate: lineTemplate(logLine),
+	}
+}
+
+// urlDefaultPorts are used when the URL has no explicit port
+var urlDefaultPorts = map[string]int{
+	"http":  80,
+	"https": 443,
+	"ws":    80,
+	"wss":   443,
+	"ftp":   21,
+}
+
+// decomposeUrl fills UrlScheme, UrlHost, UrlPort, UrlPath and SiteDomain.
+// CONNECT requests have the authority like example.com:443 instead of the URL.
+func decomposeUrl(res *LogLineData) {
+	switch {
+	case res.Url != "":
+		rawUrl := res.Url
+		if !strings.Contains(rawUrl, "://") && !strings.HasPrefix(rawUrl, "//") {
+			rawUrl = "//" + rawUrl
+		}
+		parsedUrl, err := url.Parse(rawUrl)
+		if err != nil {
+			return
+		}
+
+		res.UrlScheme = strings.ToLower(parsedUrl.Scheme)
+		if res.Method == "CONNECT" {
+			res.UrlScheme = "connect"
+		}
+		res.UrlHost = strings.ToLower(parsedUrl.Hostname())
+		res.UrlPath = parsedUrl.Path
+		if port, err := strconv.Atoi(parsedUrl.Port()); err == nil {
+			res.UrlPort = port
+		} else {
+			res.UrlPort = urlDefaultPorts[res.UrlScheme]
+		}
+	case res.DestIp != "":
+		res.UrlHost = strings.ToLower(res.DestIp)
+		res.UrlPort = res.DestPort
+	default:
+		return
+	}
+
+	res.SiteDomain = siteDomain(res.UrlHost)
+}
+
+// siteDomain returns the registrable domain (eTLD+1) by the Public Suffix List, IP addresses are returned as is
+func siteDomain(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+func classifyMessage(classes []*compiledLogErrorClass, message string) string {
+	for _, errorClass := range classes {
+		if errorClass.re.MatchString(message) {
+			return errorClass.class
+		}
+	}
+	return "other"
+}
+
+// trimAddrBrackets removes brackets of IPv6 addresses like [2a02:6b8::5d7]
+func trimAddrBrackets(addr string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// addrFamily returns ipv4 or ipv6 for IP addresses and name for host names
+func addrFamily(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	switch {
+	case err != nil:
+		return "name"
+	case ip.Unmap().Is4():
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+func (t *LogParser) matchUnit(unit string) (string, bool) {
+	for _, pattern := range t.units {
+		if instance, ok := pattern.match(unit); ok {
+			return instance, true
+		}
+	}
+	return "", false
+}
+
+func (t *LogParser) ParseSystemDLogLine(logLine string) (*SystemDLogLineRecord, error) {
 	var data SystemDLogLineRecord
-	if err := systemDLogRe.MatchToTarget(logLine, &data); err != nil {
+	if err := t.systemDLogRe.MatchToTarget(logLine, &data); err != nil {
 		return nil, errors.Join(errors.New("invalid SystemD log record format"), ErrorParse, err)
 	}
 
-	now := time.Now()
+	data.LogTime = shortLogTime(&data, time.Now(), t.location)
+
+	return &data, nil
+}
+
+// shortLogTime builds the time of a record in the short syslog format that has no year.
+// It's the latest year when the time isn't in the future, a day of clock skew is allowed.
+func shortLogTime(data *SystemDLogLineRecord, now time.Time, location *time.Location) time.Time {
+	now = now.In(location)
 	month, ok := monthMap[data.Month]
 	if !ok {
 		month = now.Month()
 	}
 
-	year := now.Year()
-	if now.Month() == time.January && month == time.December {
-		year--
+	logTime := time.Date(now.Year(), month, data.Day, data.Hour, data.Minute, data.Sec, 0, location)
+	if logTime.After(now.Add(24 * time.Hour)) {
+		logTime = time.Date(now.Year()-1, month, data.Day, data.Hour, data.Minute, data.Sec, 0, location)
 	}
-	data.LogTime = time.Date(year, month, data.Day, data.Hour, data.Minute, data.Sec, 0, time.Local)
+	return logTime
+}
 
-	return &data, nil
+// ParseJournalLogLine reads a `journalctl -o json` record with the exact timestamp,
+// the fields of the short format are in the location
+func ParseJournalLogLine(jsonLine string, location *time.Location) (*SystemDLogLineRecord, error) {
+	entry, err := ParseJournalEntry(jsonLine)
+	if err != nil {
+		return nil, errors.Join(ErrorParse, err)
+	}
+
+	logTime, err := entry.Time()
+	if err != nil {
+		return nil, errors.Join(ErrorParse, err)
+	}
+	logTime = logTime.In(location)
+
+	pid, err := strconv.Atoi(entry.ProcessId())
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid journal PID"), ErrorParse, err)
+	}
+
+	msg, err := entry.Message()
+	if err != nil {
+		return nil, errors.Join(ErrorParse, err)
+	}
+
+	return &SystemDLogLineRecord{
+		Month:     logTime.Month().String()[:3],
+		Day:       logTime.Day(),
+		Hour:      logTime.Hour(),
+		Minute:    logTime.Minute(),
+		Sec:       logTime.Second(),
+		LogTime:   logTime,
+		Host:      entry.Hostname,
+		Unit:      entry.UnitName(),
+		Pid:       pid,
+		LogRecord: msg,
+		ExactTime: true,
+	}, nil
 }
 
-func ParseDumbProxyLogLine(systemDLogLine string) (*DumbProxyLogLineRecord, error) {
+// FormatSystemDLogLine formats the record like `journalctl -o short` does
+func FormatSystemDLogLine(rec *SystemDLogLineRecord) string {
+	return fmt.Sprintf("%s %s %s[%d]: %s", rec.LogTime.Format(time.Stamp), rec.Host, rec.Unit, rec.Pid, rec.LogRecord)
+}
+
+func (t *LogParser) ParseDumbProxyLogLine(systemDLogLine string) (*DumbProxyLogLineRecord, error) {
 	var data DumbProxyLogLineRecord
-	if err := dumbProxyLogRe.MatchToTarget(systemDLogLine, &data); err != nil {
-		return nil, errors.Join(errors.New("dumbproxy log parse error"), err)
+	if err := t.dumbProxyLogRe.MatchToTarget(systemDLogLine, &data); err != nil {
+		return nil, errors.Join(errors.New("dumbproxy log parse error"), ErrorParse, err)
 	}
-	data.LogTime = time.Date(data.Year, data.Month, data.Day, data.Hour, data.Minute, data.Sec, 0, time.Local)
+	data.LogTime = time.Date(data.Year, data.Month, data.Day, data.Hour, data.Minute, data.Sec, 0, t.location)
 
 	return &data, nil
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/oriser/regroup"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed rules/default.json
+var defaultLogParserRules []byte
+
+// LogParserRules describes how log lines are parsed
+type LogParserRules struct {
+	// SystemDRegex parses the short syslog line, groups are the regroup tags of SystemDLogLineRecord
+	SystemDRegex string
+	// RecordRegex parses the dumbproxy record, groups are the regroup tags of DumbProxyLogLineRecord
+	RecordRegex string
+	// Units are the syslog identifier patterns of dumbproxy: globs like dumbproxy@* or regexes starting with ^
+	Units []string
+	// Rules are checked in order, the first matched rule sets the line type
+	Rules []LogParserRule
+	// ErrorClasses are checked in order for the rules with ClassifyError
+	ErrorClasses []LogErrorClass
+	// AuthReasonClasses are checked in order for the rules with ClassifyAuthReason
+	AuthReasonClasses []LogErrorClass
+}
+
+// LogErrorClass is a normalized error cause like refused or timeout, or a normalized auth failure reason
+type LogErrorClass struct {
+	Class string
+	Regex string
+}
+
+// LogParserRule matches a dumbproxy record and maps its regex groups to LogLineData fields
+type LogParserRule struct {
+	Name string
+	// Logger is the dumbproxy logger name like PROXY, empty means any
+	Logger string
+	// Levels are the accepted level names, empty means any
+	Levels    []string
+	NotLevels []string
+	// Regex is matched against the record message, empty means any message
+	Regex string
+	// Type is the LogLineType name like LogLineTypeProxyRequest
+	Type           string
+	IsError        bool
+	ErrorLevels    []string
+	HasRequestInfo bool
+	// Fields maps LogLineData field names to regex group names
+	Fields map[string]string
+	// Values maps LogLineData field names to constant values
+	Values map[string]string
+	// ClassifyError sets ErrorClass from ErrorMessage by the ErrorClasses of the rules
+	ClassifyError bool
+	// ClassifyAuthReason sets ErrorClass of auth failures and AUTH errors from ErrorReason or ErrorMessage
+	// by the AuthReasonClasses of the rules
+	ClassifyAuthReason bool
+	// ProxyAuth rules are used only when dumbproxy requires authentication, see LogParserParams.ProxyAuth
+	ProxyAuth bool
+}
+
+type compiledLogParserRule struct {
+	LogParserRule
+	re       *regroup.ReGroup
+	lineType LogLineType
+	// fields maps LogLineData field indexes to regex group names
+	fields map[int]string
+	// values maps LogLineData field indexes to constant values
+	values map[int]string
+}
+
+type compiledLogErrorClass struct {
+	class string
+	re    *regexp.Regexp
+}
+
+// notMappedLogLineFields are filled by the parser and the readers, not by the rules
+var notMappedLogLineFields = []string{"Source", "LogLine", "Host", "Pid", "Instance", "AddrFamily", "UrlScheme", "UrlHost", "UrlPort", "UrlPath", "SiteDomain", "LineTemplate", "FileName", "FileLine", "SourceStateKey", "SourceState"}
+
+func LoadLogParserRules(rulesPath string) (*LogParserRules, error) {
+	content := defaultLogParserRules
+	if rulesPath != "" {
+		rulesFp, err := os.Open(rulesPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open parser rules file: %s", err)
+		}
+		defer CloseOrWarn(rulesFp)
+
+		if content, err = io.ReadAll(rulesFp); err != nil {
+			return nil, fmt.Errorf("unable to read parser rules file: %s", err)
+		}
+	}
+
+	var rules LogParserRules
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse parser rules: %s", err)
+	}
+	return &rules, nil
+}
+
+func compileLogParserRule(rule LogParserRule) (*compiledLogParserRule, error) {
+	lineType, ok := LogLineTypeFromString(rule.Type)
+	if !ok {
+		return nil, fmt.Errorf("invalid type %q of parser rule %s", rule.Type, rule.Name)
+	}
+
+	regex := rule.Regex
+	if regex == "" {
+		regex = ".*"
+	}
+	groups, err := regexGroups(regex)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid regex of parser rule %s", rule.Name), err)
+	}
+
+	res := &compiledLogParserRule{
+		LogParserRule: rule,
+		re:            regroup.MustCompile(regex),
+		lineType:      lineType,
+		fields:        make(map[int]string),
+		values:        make(map[int]string),
+	}
+
+	for fieldName, group := range rule.Fields {
+		fieldIdx, err := logLineFieldIndex(fieldName, rule.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(groups, group) {
+			return nil, fmt.Errorf("regex of parser rule %s has no group %s", rule.Name, group)
+		}
+		res.fields[fieldIdx] = group
+	}
+
+	for fieldName, val := range rule.Values {
+		fieldIdx, err := logLineFieldIndex(fieldName, rule.Name)
+		if err != nil {
+			return nil, err
+		}
+		res.values[fieldIdx] = val
+	}
+
+	return res, nil
+}
+
+func compileLogErrorClass(errorClass LogErrorClass) (*compiledLogErrorClass, error) {
+	re, err := regexp.Compile(errorClass.Regex)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid regex of error class %s", errorClass.Class), err)
+	}
+	return &compiledLogErrorClass{class: errorClass.Class, re: re}, nil
+}
+
+func logLineFieldIndex(fieldName string, ruleName string) (int, error) {
+	field, ok := reflect.TypeOf(LogLineData{}).FieldByName(fieldName)
+	if !ok || slices.Contains(notMappedLogLineFields, fieldName) {
+		return 0, fmt.Errorf("field %s can't be set by parser rule %s", fieldName, ruleName)
+	}
+	switch field.Type.Kind() {
+	case reflect.String, reflect.Int, reflect.Bool:
+		return field.Index[0], nil
+	default:
+		return 0, fmt.Errorf("field %s of type %s can't be set by parser rule %s", fieldName, field.Type, ruleName)
+	}
+}
+
+// unitPattern matches dumbproxy units and gets the instance name of the unit.
+// The instance is the regex group "instance", the part after @ of templated units or the whole unit name.
+type unitPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileUnitPattern(pattern string) (*unitPattern, error) {
+	if strings.HasPrefix(pattern, "^") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("invalid unit regex %s", pattern), err)
+		}
+		return &unitPattern{re: re}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid unit glob %s", pattern), err)
+	}
+	return &unitPattern{glob: pattern}, nil
+}
+
+func (t *unitPattern) match(unit string) (string, bool) {
+	if t.re != nil {
+		match := t.re.FindStringSubmatch(unit)
+		if match == nil {
+			return "", false
+		}
+		if idx := t.re.SubexpIndex("instance"); idx > 0 && match[idx] != "" {
+			return match[idx], true
+		}
+	} else if ok, _ := path.Match(t.glob, unit); !ok {
+		return "", false
+	}
+
+	if _, instance, found := strings.Cut(unit, "@"); found && instance != "" {
+		return instance, true
+	}
+	return unit, true
+}
+
+func (t *compiledLogParserRule) matchRecord(record *DumbProxyLogLineRecord) (map[string]string, bool) {
+	if t.Logger != "" && t.Logger != record.Logger {
+		return nil, false
+	}
+	if len(t.Levels) > 0 && !slices.Contains(t.Levels, record.LevelName) {
+		return nil, false
+	}
+	if slices.Contains(t.NotLevels, record.LevelName) {
+		return nil, false
+	}
+
+	groups, err := t.re.Groups(record.LogRecord)
+	if err != nil {
+		return nil, false
+	}
+	return groups, true
+}
+
+func (t *compiledLogParserRule) apply(record *DumbProxyLogLineRecord, groups map[string]string, res *LogLineData) {
+	res.LogLineType = t.lineType
+	res.IsError = t.IsError || slices.Contains(t.ErrorLevels, record.LevelName)
+	res.HasRequestInfo = t.HasRequestInfo
+
+	resValue := reflect.ValueOf(res).Elem()
+	for fieldIdx, val := range t.values {
+		t.setField(resValue.Field(fieldIdx), val)
+	}
+	for fieldIdx, group := range t.fields {
+		t.setField(resValue.Field(fieldIdx), groups[group])
+	}
+}
+
+func (t *compiledLogParserRule) setField(field reflect.Value, val string) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Int:
+		if val == "" {
+			return
+		}
+		intVal, err := strconv.Atoi(val)
+		if err != nil {
+			log.Errorf("Unable to parse value of rule %s: %s", t.Name, err)
+			return
+		}
+		field.SetInt(int64(intVal))
+	case reflect.Bool:
+		field.SetBool(val != "")
+	}
+}
+
+// requireRegexGroups compiles the regex checking that it has all groups used by regroup tags of the target
+func requireRegexGroups(regex string, target interface{}) (*regroup.ReGroup, error) {
+	groups, err := regexGroups(regex)
+	if err != nil {
+		return nil, err
+	}
+
+	targetType := reflect.TypeOf(target)
+	for i := 0; i < targetType.NumField(); i++ {
+		group := targetType.Field(i).Tag.Get("regroup")
+		if group != "" && !slices.Contains(groups, group) {
+			return nil, fmt.Errorf("regex has no group %s", group)
+		}
+	}
+	return regroup.MustCompile(regex), nil
+}
+
+func regexGroups(regex string) ([]string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	return re.SubexpNames(), nil
+}
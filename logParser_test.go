@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -18,7 +20,6 @@ func TestParseSystemDLogLine(t *testing.T) {
 
 	var rec *SystemDLogLineRecord
 	var err error
-	now := time.Now()
 
 	rec, err = ParseSystemDLogLine(logLine1)
 	assert.NoError(t, err)
@@ -28,7 +29,7 @@ func TestParseSystemDLogLine(t *testing.T) {
 		Hour:      13,
 		Minute:    0,
 		Sec:       47,
-		LogTime:   time.Date(now.Year(), time.June, 21, 13, 0, 47, 0, now.Location()),
+		LogTime:   shortLogTimeOf(time.June, 21, 13, 0, 47),
 		Host:      "p487-2-am.jethelix.ru",
 		Unit:      "dumbproxy",
 		Pid:       111654,
@@ -43,7 +44,7 @@ func TestParseSystemDLogLine(t *testing.T) {
 		Hour:      0,
 		Minute:    7,
 		Sec:       26,
-		LogTime:   time.Date(now.Year(), time.June, 18, 0, 7, 26, 0, now.Location()),
+		LogTime:   shortLogTimeOf(time.June, 18, 0, 7, 26),
 		Host:      "p487-2-am.jethelix.ru",
 		Unit:      "dumbproxy",
 		Pid:       82403,
@@ -58,7 +59,7 @@ func TestParseSystemDLogLine(t *testing.T) {
 		Hour:      13,
 		Minute:    0,
 		Sec:       18,
-		LogTime:   time.Date(now.Year(), time.June, 21, 13, 0, 18, 0, now.Location()),
+		LogTime:   shortLogTimeOf(time.June, 21, 13, 0, 18),
 		Host:      "p487-2-am.jethelix.ru",
 		Unit:      "dumbproxy",
 		Pid:       111654,
@@ -73,7 +74,7 @@ func TestParseSystemDLogLine(t *testing.T) {
 		Hour:      11,
 		Minute:    18,
 		Sec:       52,
-		LogTime:   time.Date(now.Year(), time.June, 18, 11, 18, 52, 0, now.Location()),
+		LogTime:   shortLogTimeOf(time.June, 18, 11, 18, 52),
 		Host:      "p487-2-am.jethelix.ru",
 		Unit:      "dumbproxy",
 		Pid:       96234,
@@ -85,6 +86,31 @@ func TestParseSystemDLogLine(t *testing.T) {
 	assert.Nil(t, rec)
 }
 
+func TestShortLogTime(t *testing.T) {
+	location := Must1(time.LoadLocation("Asia/Tokyo"))
+	march1 := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, testCase := range []struct {
+		now      time.Time
+		month    string
+		expected time.Time
+	}{
+		{march1, "Feb", time.Date(2024, time.February, 28, 10, 0, 0, 0, location)},
+		{march1, "Mar", time.Date(2023, time.March, 28, 10, 0, 0, 0, location)},
+		{march1, "Jun", time.Date(2023, time.June, 28, 10, 0, 0, 0, location)},
+		{march1, "Dec", time.Date(2023, time.December, 28, 10, 0, 0, 0, location)},
+		{time.Date(2024, time.March, 27, 12, 0, 0, 0, time.UTC), "Mar", time.Date(2024, time.March, 28, 10, 0, 0, 0, location)},
+	} {
+		rec := &SystemDLogLineRecord{Month: testCase.month, Day: 28, Hour: 10}
+		assert.Equal(t, testCase.expected, shortLogTime(rec, testCase.now, location), testCase.month)
+	}
+}
+
+func shortLogTimeOf(month time.Month, day, hour, minute, sec int) time.Time {
+	rec := &SystemDLogLineRecord{Month: month.String()[:3], Day: day, Hour: hour, Minute: minute, Sec: sec}
+	return shortLogTime(rec, time.Now(), time.Local)
+}
+
 func TestParseDumbProxyLogLine(t *testing.T) {
 	logLine1 := readFileToString("test/data/log-line-request-http-info.txt")
 	logLine2 := readFileToString("test/data/log-line-request.txt")
@@ -93,7 +119,6 @@ func TestParseDumbProxyLogLine(t *testing.T) {
 
 	var rec *DumbProxyLogLineRecord
 	var err error
-	now := time.Now()
 
 	rec, err = ParseDumbProxyLogLine(Must1(ParseSystemDLogLine(logLine1)).LogRecord)
 	assert.NoError(t, err)
@@ -138,7 +163,7 @@ func TestParseDumbProxyLogLine(t *testing.T) {
 		Hour:      13,
 		Minute:    0,
 		Sec:       18,
-		LogTime:   time.Date(now.Year(), time.June, 21, 13, 0, 18, 0, time.Local),
+		LogTime:   time.Date(2024, time.June, 21, 13, 0, 18, 0, time.Local),
 		Logger:    "HTTPSRV",
 		FileName:  "server.go",
 		FileLine:  3195,
@@ -155,7 +180,7 @@ func TestParseDumbProxyLogLine(t *testing.T) {
 		Hour:      11,
 		Minute:    18,
 		Sec:       52,
-		LogTime:   time.Date(now.Year(), time.June, 18, 11, 18, 52, 0, time.Local),
+		LogTime:   time.Date(2024, time.June, 18, 11, 18, 52, 0, time.Local),
 		Logger:    "PROXY",
 		FileName:  "handler.go",
 		FileLine:  51,
@@ -183,19 +208,27 @@ func TestParseLogLine2(t *testing.T) {
 	assert.Equal(t, &LogLineData{
 		LogLineType:    LogLineTypeProxyRequest,
 		LogLine:        "Jun 18 00:07:26 p487-2-am.jethelix.ru dumbproxy[82403]: PROXY   : 2024/06/18 00:07:26 handler.go:138: INFO     Request: 143.178.228.182:64154 => 2.56.204.64:443 \"andre487\" HTTP/1.1 GET http://ifconfig.co/",
-		LogTime:        time.Date(2024, 6, 18, 0, 7, 26, 0, time.Local),
+		LogTime:        time.Date(2024, 6, 18, 0, 7, 26, 0, time.Local).UTC(),
 		Host:           "p487-2-am.jethelix.ru",
 		Pid:            82403,
+		Instance:       "dumbproxy",
 		HasRequestInfo: true,
 		FileName:       "handler.go",
 		FileLine:       138,
 		SrcIp:          "143.178.228.182",
+		SrcPort:        64154,
 		DestIp:         "2.56.204.64",
 		DestPort:       443,
+		AddrFamily:     "ipv4",
 		Username:       "andre487",
 		Proto:          "HTTP/1.1",
 		Method:         "GET",
 		Url:            "http://ifconfig.co/",
+		UrlScheme:      "http",
+		UrlHost:        "ifconfig.co",
+		UrlPort:        80,
+		UrlPath:        "/",
+		SiteDomain:     "ifconfig.co",
 	}, res)
 
 	res, err = ParseLogLine(logLineHttpInfo)
@@ -204,16 +237,23 @@ func TestParseLogLine2(t *testing.T) {
 	assert.Equal(t, &LogLineData{
 		LogLineType:    LogLineTypeProxyRequestHttpInfo,
 		LogLine:        "Jun 21 13:00:47 p487-2-am.jethelix.ru dumbproxy[111654]: PROXY   : 2024/06/21 13:00:47 handler.go:106: INFO     143.178.232.21:57190 POST http://e5.o.lencr.org/ 200 OK",
-		LogTime:        time.Date(2024, 6, 21, 13, 0, 47, 0, time.Local),
+		LogTime:        time.Date(2024, 6, 21, 13, 0, 47, 0, time.Local).UTC(),
 		Host:           "p487-2-am.jethelix.ru",
 		Pid:            111654,
+		Instance:       "dumbproxy",
 		HasRequestInfo: true,
 		FileName:       "handler.go",
 		FileLine:       106,
 		SrcIp:          "143.178.232.21",
+		SrcPort:        57190,
 		Method:         "POST",
 		Url:            "http://e5.o.lencr.org/",
 		Status:         200,
+		UrlScheme:      "http",
+		UrlHost:        "e5.o.lencr.org",
+		UrlPort:        80,
+		UrlPath:        "/",
+		SiteDomain:     "lencr.org",
 	}, res)
 
 	res, err = ParseLogLine(logLineReqError)
@@ -223,11 +263,20 @@ func TestParseLogLine2(t *testing.T) {
 		LogLineType:  LogLineTypeProxyRequestError,
 		IsError:      true,
 		LogLine:      "Jun 18 00:42:21 p487-2-am.jethelix.ru dumbproxy[90996]: PROXY   : 2024/06/18 00:42:21 handler.go:51: ERROR    Can't satisfy CONNECT request: dial tcp [2a02:6b8::5d7]:443: connect: network is unreachable",
-		LogTime:      time.Date(2024, 6, 18, 0, 42, 21, 0, time.Local),
+		LogTime:      time.Date(2024, 6, 18, 0, 42, 21, 0, time.Local).UTC(),
 		FileName:     "handler.go",
 		FileLine:     51,
 		Host:         "p487-2-am.jethelix.ru",
 		Pid:          90996,
+		Instance:     "dumbproxy",
+		DestIp:       "2a02:6b8::5d7",
+		DestPort:     443,
+		AddrFamily:   "ipv6",
+		UpstreamOp:   "dial",
+		ErrorClass:   "unreachable",
+		UrlHost:      "2a02:6b8::5d7",
+		UrlPort:      443,
+		SiteDomain:   "2a02:6b8::5d7",
 		ErrorMessage: "Can't satisfy CONNECT request: dial tcp [2a02:6b8::5d7]:443: connect: network is unreachable",
 	}, res)
 
@@ -235,18 +284,240 @@ func TestParseLogLine2(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 	assert.Equal(t, &LogLineData{
-		LogLineType:  LogLineTypeHttpSrvError,
+		LogLineType:  LogLineTypeTlsHandshakeError,
 		IsError:      true,
 		LogLine:      "Jun 21 13:00:18 p487-2-am.jethelix.ru dumbproxy[111654]: HTTPSRV : 2024/06/21 13:00:18 server.go:3195: http: TLS handshake error from 143.178.232.21:57019: EOF",
-		LogTime:      time.Date(2024, 6, 21, 13, 0, 18, 0, time.Local),
+		LogTime:      time.Date(2024, 6, 21, 13, 0, 18, 0, time.Local).UTC(),
 		Host:         "p487-2-am.jethelix.ru",
 		Pid:          111654,
+		Instance:     "dumbproxy",
 		FileName:     "server.go",
 		FileLine:     3195,
+		SrcIp:        "143.178.232.21",
+		SrcPort:      57019,
+		ErrorClass:   "reset",
+		ErrorReason:  "EOF",
 		ErrorMessage: "http: TLS handshake error from 143.178.232.21:57019: EOF",
 	}, res)
 }
 
+func TestParseJournalLogLine(t *testing.T) {
+	logLine := readFileToString("test/data/log-line-journal.json")
+	logTime := time.UnixMicro(1718669246123456).Local()
+
+	rec, err := ParseJournalLogLine(logLine, time.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, &SystemDLogLineRecord{
+		Month:     logTime.Month().String()[:3],
+		Day:       logTime.Day(),
+		Hour:      logTime.Hour(),
+		Minute:    logTime.Minute(),
+		Sec:       logTime.Second(),
+		LogTime:   logTime,
+		Host:      "p487-2-am.jethelix.ru",
+		Unit:      "dumbproxy",
+		Pid:       82403,
+		LogRecord: "PROXY   : 2024/06/18 00:07:26 handler.go:138: INFO     Request: 143.178.228.182:64154 => 2.56.204.64:443 \"andre487\" HTTP/1.1 GET http://ifconfig.co/",
+		ExactTime: true,
+	}, rec)
+
+	res, err := ParseLogLineOfFormat(logLine, LogFormatJournalJson)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLineTypeProxyRequest, res.LogLineType)
+	assert.Equal(t, logTime.UTC(), res.LogTime)
+	assert.Equal(t, "andre487", res.Username)
+	assert.Equal(t, logTime.Format(time.Stamp)+" p487-2-am.jethelix.ru dumbproxy[82403]: "+rec.LogRecord, res.LogLine)
+
+	res, err = ParseLogLineOfFormat("FOO", LogFormatJournalJson)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLineTypeUnmatched, res.LogLineType)
+}
+
+func TestLogParserRules(t *testing.T) {
+	var rules LogParserRules
+	Must0(json.Unmarshal(defaultLogParserRules, &rules))
+	rules.Units = append(rules.Units, "otherproxy")
+	rules.Rules = append([]LogParserRule{{
+		Name:    "handshake",
+		Logger:  "HTTPSRV",
+		Regex:   "^http: TLS handshake error from (?P<srcIp>\\S+):\\d+: (?P<reason>.+)$",
+		Type:    "LogLineTypeHttpSrvError",
+		IsError: true,
+		Fields:  map[string]string{"SrcIp": "srcIp", "ErrorMessage": "reason"},
+	}}, rules.Rules...)
+
+	rulesPath := t.TempDir() + "/rules.json"
+	Must0(os.WriteFile(rulesPath, Must1(json.Marshal(rules)), 0644))
+	parser := Must1(NewLogParser(LogParserParams{RulesPath: rulesPath}))
+
+	logLine := strings.Replace(readFileToString("test/data/log-line-httpsrv-error.txt"), "dumbproxy[", "otherproxy[", 1)
+	res, err := parser.ParseLogLine(logLine)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLineTypeHttpSrvError, res.LogLineType)
+	assert.True(t, res.IsError)
+	assert.Equal(t, "143.178.232.21", res.SrcIp)
+	assert.Equal(t, "EOF", res.ErrorMessage)
+
+	res, err = DefaultLogParser().ParseLogLine(logLine)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLineTypeOtherUnit, res.LogLineType)
+
+	rules.Rules[0].Fields["LogLine"] = "reason"
+	Must0(os.WriteFile(rulesPath, Must1(json.Marshal(rules)), 0644))
+	_, err = NewLogParser(LogParserParams{RulesPath: rulesPath})
+	assert.ErrorContains(t, err, "field LogLine can't be set by parser rule handshake")
+}
+
+func TestParseUpstreamErrors(t *testing.T) {
+	logLine := readFileToString("test/data/log-line-request-error.txt")
+	origMessage := "dial tcp [2a02:6b8::5d7]:443: connect: network is unreachable"
+
+	for message, expected := range map[string][5]string{
+		"dial tcp 1.2.3.4:443: i/o timeout":                                         {"dial", "1.2.3.4", "443", "ipv4", "timeout"},
+		"dial tcp 1.2.3.4:80: connect: connection refused":                          {"dial", "1.2.3.4", "80", "ipv4", "refused"},
+		"dial tcp: lookup foo.example.com on 127.0.0.53:53: no such host":           {"dial", "foo.example.com", "0", "name", "dns"},
+		"read tcp 10.0.0.1:5123->[2a02:6b8::1]:443: read: connection reset by peer": {"read", "2a02:6b8::1", "443", "ipv6", "reset"},
+		"remote error: tls: handshake failure":                                      {"tls", "", "0", "", "tls"},
+		"something strange":                                                         {"", "", "0", "", ""},
+	} {
+		res := Must1(ParseLogLine(strings.Replace(logLine, origMessage, message, 1)))
+		assert.Equal(t, LogLineTypeProxyRequestError, res.LogLineType)
+		assert.Equal(t, expected, [5]string{res.UpstreamOp, res.DestIp, strconv.Itoa(res.DestPort), res.AddrFamily, res.ErrorClass}, message)
+	}
+}
+
+func TestParseTlsHandshakeErrors(t *testing.T) {
+	logLine := readFileToString("test/data/log-line-httpsrv-error.txt")
+	origMessage := "143.178.232.21:57019: EOF"
+
+	for message, expected := range map[string][4]string{
+		"[2a02:6b8::1]:40100: tls: first record does not look like a TLS handshake":        {"2a02:6b8::1", "40100", "tls: first record does not look like a TLS handshake", "tls"},
+		"1.2.3.4:5555: read tcp 5.6.7.8:443->1.2.3.4:5555: read: connection reset by peer": {"1.2.3.4", "5555", "read tcp 5.6.7.8:443->1.2.3.4:5555: read: connection reset by peer", "reset"},
+	} {
+		res := Must1(ParseLogLine(strings.Replace(logLine, origMessage, message, 1)))
+		assert.Equal(t, LogLineTypeTlsHandshakeError, res.LogLineType)
+		assert.Equal(t, expected, [4]string{res.SrcIp, strconv.Itoa(res.SrcPort), res.ErrorReason, res.ErrorClass}, message)
+	}
+}
+
+func TestParseHttpInfo(t *testing.T) {
+	linePrefix := "Jun 21 13:00:47 p487-2-am.jethelix.ru dumbproxy[111654]: PROXY   : 2024/06/21 13:00:47 handler.go:106: INFO     "
+
+	for record, expected := range map[string][5]string{
+		"143.178.232.21:57190 GET http://example.com/ 404 Not Found":                     {"143.178.232.21", "57190", "GET", "http://example.com/", "404"},
+		"143.178.232.21:57190 GET http://example.com/ 407 Proxy Authentication Required": {"143.178.232.21", "57190", "GET", "http://example.com/", "407"},
+		"[2a02:6b8::1]:40100 POST http://example.com/a b 502 Bad Gateway":                {"2a02:6b8::1", "40100", "POST", "http://example.com/a b", "502"},
+		"143.178.232.21:57190 GET http://example.com/ 200 500 200 OK":                    {"143.178.232.21", "57190", "GET", "http://example.com/ 200 500", "200"},
+		"143.178.232.21:57190 GET http://example.com/ 204":                               {"143.178.232.21", "57190", "GET", "http://example.com/", "204"},
+	} {
+		res := Must1(ParseLogLine(linePrefix + record))
+		assert.Equal(t, LogLineTypeProxyRequestHttpInfo, res.LogLineType, record)
+		assert.Equal(t, expected, [5]string{res.SrcIp, strconv.Itoa(res.SrcPort), res.Method, res.Url, strconv.Itoa(res.Status)}, record)
+	}
+
+	res := Must1(ParseLogLine(linePrefix + "something unexpected"))
+	assert.Equal(t, LogLineTypeParseFailure, res.LogLineType)
+	assert.Equal(t, "no rule for PROXY INFO record", res.ErrorReason)
+
+	res = Must1(ParseLogLine("Jun 21 13:00:47 p487-2-am.jethelix.ru dumbproxy[111654]: not a dumbproxy record"))
+	assert.Equal(t, LogLineTypeParseFailure, res.LogLineType)
+	assert.Equal(t, "invalid record format", res.ErrorReason)
+}
+
+func TestDecomposeUrl(t *testing.T) {
+	for rawUrl, expected := range map[string][5]string{
+		"https://rr3---sn-4g5e6nsz.googlevideo.com/videoplayback?id=1": {"https", "rr3---sn-4g5e6nsz.googlevideo.com", "443", "/videoplayback", "googlevideo.com"},
+		"http://Example.co.uk:8080/a b":                                {"http", "example.co.uk", "8080", "/a b", "example.co.uk"},
+		"http://[2a02:6b8::1]/":                                        {"http", "2a02:6b8::1", "80", "/", "2a02:6b8::1"},
+		"//www.github.com:443":                                         {"connect", "www.github.com", "443", "", "github.com"},
+		"api.telegram.org:443":                                         {"connect", "api.telegram.org", "443", "", "telegram.org"},
+		"http://localhost/":                                            {"http", "localhost", "80", "/", "localhost"},
+	} {
+		res := &LogLineData{Url: rawUrl, Method: "GET"}
+		if !strings.HasPrefix(rawUrl, "http") {
+			res.Method = "CONNECT"
+		}
+		decomposeUrl(res)
+		assert.Equal(t, expected, [5]string{res.UrlScheme, res.UrlHost, strconv.Itoa(res.UrlPort), res.UrlPath, res.SiteDomain}, rawUrl)
+	}
+}
+
+func TestParseAuthEvents(t *testing.T) {
+	// dumbproxy logs the request line before the auth check, with an empty user when the check failed
+	requestLine := readFileToString("test/data/log-line-request.txt")
+	failedRequestLine := strings.Replace(requestLine, `"andre487"`, `""`, 1)
+	authParser := Must1(NewLogParser(LogParserParams{ProxyAuth: true}))
+
+	for _, tc := range []struct {
+		parser   *LogParser
+		logLine  string
+		lineType LogLineType
+		expected [4]string
+	}{
+		{authParser, failedRequestLine, LogLineTypeProxyAuthFailure, [4]string{"failure", "", "no valid credentials", "rejected"}},
+		{authParser, requestLine, LogLineTypeProxyRequest, [4]string{"", "andre487", "", ""}},
+		{DefaultLogParser(), failedRequestLine, LogLineTypeProxyRequest, [4]string{"", "", "", ""}},
+	} {
+		res := Must1(tc.parser.ParseLogLine(tc.logLine))
+		assert.Equal(t, tc.lineType, res.LogLineType, tc.logLine)
+		assert.Equal(t, "143.178.228.182", res.SrcIp, tc.logLine)
+		assert.Equal(t, 64154, res.SrcPort, tc.logLine)
+		assert.Equal(t, "http://ifconfig.co/", res.Url, tc.logLine)
+		assert.Equal(t, tc.expected, [4]string{res.AuthOutcome, res.Username, res.ErrorReason, res.ErrorClass}, tc.logLine)
+	}
+
+	// Events and errors of the AUTH module are classified by the auth reasons, not by the upstream error classes
+	linePrefix := "Jun 21 13:00:18 p487-2-am.jethelix.ru dumbproxy[111654]: AUTH   : 2024/06/21 13:00:18 basic.go:120: "
+	for message, expected := range map[string][6]string{
+		`ERROR authentication failed for user "bob" from 1.2.3.4:5555: bad password`:        {"failure", "bob", "1.2.3.4", "5555", "bad password", "bad password"},
+		`ERROR authentication failed for user alice from [2a02:6b8::1]:40100: no such user`: {"failure", "alice", "2a02:6b8::1", "40100", "no such user", "unknown user"},
+		`ERROR authentication failed from 1.2.3.4:5555: missing credentials`:                {"failure", "", "1.2.3.4", "5555", "missing credentials", "missing credentials"},
+		`ERROR authentication failed for user bob from 1.2.3.4:5555: account locked`:        {"failure", "bob", "1.2.3.4", "5555", "account locked", "other"},
+		`INFO authentication succeeded for user "bob" from 1.2.3.4:5556`:                    {"success", "bob", "1.2.3.4", "5556", "", ""},
+		`ERROR open /etc/dumbproxy.htpasswd: no such file or directory`:                     {"", "", "", "0", "", "password file"},
+		`ERROR dial tcp 127.0.0.1:6379: connect: connection refused`:                        {"", "", "", "0", "", "backend"},
+		`CRITICAL something else`:     {"", "", "", "0", "", "other"},
+		`INFO password file reloaded`: {"", "", "", "0", "", ""},
+	} {
+		res := Must1(authParser.ParseLogLine(linePrefix + message))
+		assert.Equal(t, LogLineTypeAuthModuleLog, res.LogLineType, message)
+		assert.Equal(t, expected, [6]string{res.AuthOutcome, res.Username, res.SrcIp, strconv.Itoa(res.SrcPort), res.ErrorReason, res.ErrorClass}, message)
+		assert.Equal(t, !strings.HasPrefix(message, "INFO"), res.IsError, message)
+	}
+}
+
+func TestLogParserUnits(t *testing.T) {
+	logLine := readFileToString("test/data/log-line-request.txt")
+	parser := Must1(NewLogParser(LogParserParams{Units: []string{"dumbproxy@*", "^proxy-(?P<instance>\\w+)$", "corp-proxy"}}))
+
+	for unit, instance := range map[string]string{
+		"dumbproxy@corp": "corp",
+		"proxy-vps":      "vps",
+		"corp-proxy":     "corp-proxy",
+		"dumbproxy":      "",
+	} {
+		res, err := parser.ParseLogLine(strings.Replace(logLine, "dumbproxy[", unit+"[", 1))
+		assert.NoError(t, err)
+		assert.Equal(t, instance, res.Instance)
+		if instance == "" {
+			assert.Equal(t, LogLineTypeOtherUnit, res.LogLineType)
+		} else {
+			assert.Equal(t, LogLineTypeProxyRequest, res.LogLineType)
+		}
+	}
+}
+
+func TestLogLineTypeFromString(t *testing.T) {
+	for lineType := LogLineTypeUnmatched; lineType < logLineTypesEnd; lineType++ {
+		res, ok := LogLineTypeFromString(lineType.String())
+		assert.True(t, ok)
+		assert.Equal(t, lineType, res)
+	}
+
+	_, ok := LogLineTypeFromString("FOO")
+	assert.False(t, ok)
+}
+
 func TestBigLog2(t *testing.T) {
 	logText := readFileToString("test/data/dumbproxy-big.log")
 	for _, logLine := range strings.Split(logText, "\n") {
@@ -254,7 +525,7 @@ func TestBigLog2(t *testing.T) {
 		if err != nil || res == nil {
 			t.Fatalf("error %s: unable to parse log line: %s", err, logLine)
 		}
-		if res.LogLineType == LogLineTypeUnmatched || res.LogLineType == LogLineTypeProxyUnknown {
+		if res.LogLineType == LogLineTypeUnmatched || res.LogLineType == LogLineTypeParseFailure {
 			t.Fatalf("wrond line tyoe %v for line %s", res.LogLineType, logLine)
 		}
 		if res.LogLineType.String() == "LogLineType__UNKNOWN" {
@@ -1,142 +1,199 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"io"
-	"os"
-	"os/exec"
-	"strings"
+	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/hashicorp/go-multierror"
 	log "github.com/sirupsen/logrus"
 )
 
+type LogReaderStatus string
+
+const (
+	LogReaderStatusRunning LogReaderStatus = "running"
+	LogReaderStatusBackoff LogReaderStatus = "backing off"
+	LogReaderStatusDead    LogReaderStatus = "dead"
+	LogReaderStatusStopped LogReaderStatus = "stopped"
+)
+
+// LogReaderState is a snapshot of the reader supervisor state
+type LogReaderState struct {
+	Name         string
+	Status       LogReaderStatus
+	Since        time.Time
+	Restarts     int
+	LastExitCode int
+	LastError    string
+}
+
 type LogReaderParams struct {
-	LogProducerCommand  string
-	ExecDir             string
+	Name   string
+	Source LogSource
+	// Parser is DefaultLogParser by default
+	Parser *LogParser
+	// ProcessRestartLimit is the number of consecutive failed restarts, negative means unlimited
 	ProcessRestartLimit int
-	LastHandledTime     time.Time
+	BackoffMin          time.Duration
+	BackoffMax          time.Duration
 }
 
 type LogReader struct {
 	LogReaderParams
-	running bool
-	cmd     *exec.Cmd
-	stdout  io.ReadCloser
+	stateLock sync.Mutex
+	state     LogReaderState
+	// fingerprinter is replaced on restarts, the lines are read again from the resume state
+	fingerprinter *RecordFingerprinter
 }
 
 func NewLogReader(params LogReaderParams) (*LogReader, error) {
-	if params.LogProducerCommand == "" {
-		params.LogProducerCommand = "sudo journalctl -fu dumbproxy.service"
+	if params.Source == nil {
+		return nil, errors.New("log source is required for LogReader")
+	}
+	if params.Name == "" {
+		params.Name = DefaultSourceName
+	}
+	if params.Parser == nil {
+		params.Parser = DefaultLogParser()
 	}
 	if params.ProcessRestartLimit == 0 {
 		params.ProcessRestartLimit = 3
 	}
+	if params.BackoffMin == 0 {
+		params.BackoffMin = 2 * time.Second
+	}
+	if params.BackoffMax < params.BackoffMin {
+		params.BackoffMax = max(5*time.Minute, params.BackoffMin)
+	}
 
-	res := &LogReader{LogReaderParams: params, running: true}
-	if err := res.launchProcess(); err != nil {
+	res := &LogReader{
+		LogReaderParams: params,
+		state:           LogReaderState{Name: params.Name, Status: LogReaderStatusRunning, Since: time.Now()},
+		fingerprinter:   NewRecordFingerprinter(),
+	}
+	if err := res.Source.Open(); err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (t *LogReader) ReadLogStreamToChannel(logCh chan *LogLineData) {
-	defer log.Infoln("ReadLogStreamToChannel is finished")
-	defer close(logCh)
+// ReadLogStreamToChannel reads the source until the context is done or the reader is dead.
+// The channel is shared by several readers so it's not closed here.
+// Lines that are already read are always sent to the channel, so the writer can persist them on shutdown.
+func (t *LogReader) ReadLogStreamToChannel(ctx context.Context, logCh chan<- *LogLineData) {
+	defer log.Infof("ReadLogStreamToChannel for %s is finished", t.Name)
 
-	runNum := 0
-	for t.running {
-		scanner := bufio.NewScanner(t.stdout)
-		for t.running && scanner.Scan() {
-			data, err := ParseLogLine(scanner.Text())
-			if err == nil {
-				logCh <- data
-				runNum = 0
-				t.LastHandledTime = time.Now()
-			} else {
-				log.Warnf("Parse log error: %s", err)
-			}
+	closeSource := func() {
+		if err := t.Source.Close(); err != nil {
+			log.Warnf("Stop reader %s error: %s", t.Name, err)
 		}
-
-		if !t.running {
-			return
+	}
+	stopCloseOnDone := context.AfterFunc(ctx, closeSource)
+	defer func() {
+		if stopCloseOnDone() {
+			closeSource()
 		}
+	}()
 
-		if err := scanner.Err(); err != nil {
-			log.Warnf("Scanner close error: %s", err)
-		}
+	runNum := 0
+	for ctx.Err() == nil {
+		line, err := t.Source.ReadLine()
+		if err == nil {
+			if runNum > 0 {
+				runNum = 0
+				t.setStatus(LogReaderStatusRunning, nil)
+			}
 
-		_, waitErr := t.cmd.Process.Wait()
-		if waitErr != nil {
-			log.Warnf("Wait process error: %s", waitErr)
+			data, err := t.Parser.ParseLogLineOfFormat(line.Text, line.Format)
+			if err != nil {
+				log.Warnf("Parse log error in %s: %s", t.Name, err)
+				data = NewParseFailureLogLine(line.Text, err)
+			}
+			data.Source = t.Name
+			data.SourceStateKey = line.StateKey
+			data.SourceState = line.State
+			data.Fingerprint = t.fingerprinter.Fingerprint(data)
+			logCh <- data
+			continue
 		}
 
-		runNum++
-		if runNum >= t.ProcessRestartLimit {
+		if ctx.Err() != nil {
 			break
 		}
 
-		log.Infoln("Waiting for timeout before restarting log reader")
-		time.Sleep(2 * time.Second)
-		log.Infoln("Restarting log reader")
-
-		if err := t.launchProcess(); err != nil {
-			log.Errorf("Restart process error: %s", err)
-			break
+		if errors.Is(err, io.EOF) {
+			err = nil
+		} else {
+			log.Warnf("Log source %s read error: %s", t.Name, err)
 		}
-	}
-}
-
-func (t *LogReader) Stop() {
-	t.running = false
 
-	var resErr error
-	if t.stdout != nil {
-		if err := t.stdout.Close(); err != nil {
-			resErr = multierror.Append(resErr, err)
+		runNum++
+		if t.ProcessRestartLimit > 0 && runNum > t.ProcessRestartLimit {
+			log.Errorf("Log reader %s is dead after %d restarts", t.Name, t.ProcessRestartLimit)
+			t.setStatus(LogReaderStatusDead, err)
+			return
 		}
-	}
 
-	if t.cmd != nil && t.cmd.Process != nil {
-		if err := t.cmd.Process.Kill(); err != nil {
-			resErr = multierror.Append(resErr, err)
+		delay := t.backoffDelay(runNum)
+		t.setStatus(LogReaderStatusBackoff, err)
+		log.Infof("Waiting for %s before restarting log reader %s", delay.Round(time.Millisecond), t.Name)
+		select {
+		case <-ctx.Done():
+			continue
+		case <-time.After(delay):
 		}
 
-		if _, err := t.cmd.Process.Wait(); err != nil {
-			resErr = multierror.Append(resErr, err)
+		log.Infof("Restarting log reader %s", t.Name)
+		t.stateLock.Lock()
+		t.state.Restarts++
+		t.stateLock.Unlock()
+		t.fingerprinter = NewRecordFingerprinter()
+		if err := t.Source.Open(); err != nil {
+			log.Errorf("Restart log source %s error: %s", t.Name, err)
 		}
 	}
 
-	if resErr != nil {
-		log.Warnf("Stop reader error: %s", resErr)
-	}
+	t.setStatus(LogReaderStatusStopped, nil)
 }
 
 func (t *LogReader) IsAlive() bool {
-	return t.running
+	status := t.State().Status
+	return status != LogReaderStatusDead && status != LogReaderStatusStopped
 }
 
-func (t *LogReader) launchProcess() error {
-	cmdParts := strings.Split(t.LogProducerCommand, " ")
-	cmdParts = append(cmdParts, "--since", t.LastHandledTime.Format("2006-01-02 15:04:05"))
-	log.Infof("Launching log process: %v", cmdParts)
+func (t *LogReader) State() LogReaderState {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.state
+}
 
-	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-	cmd.Dir = t.ExecDir
-	cmd.Env = append(os.Environ(), "IN_LOG_READER=1")
+func (t *LogReader) setStatus(status LogReaderStatus, err error) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
 
-	stdout, err := cmd.StdoutPipe()
+	if t.state.Status != status {
+		t.state.Since = time.Now()
+	}
+	t.state.Status = status
 	if err != nil {
-		return err
+		t.state.LastError = err.Error()
 	}
+	if processSource, ok := t.Source.(ProcessLogSource); ok {
+		t.state.LastExitCode = processSource.LastExitCode()
+	}
+}
 
-	t.cmd = cmd
-	t.stdout = stdout
-
-	if err := cmd.Start(); err != nil {
-		return err
+// backoffDelay grows exponentially from BackoffMin to BackoffMax with ±20% jitter
+func (t *LogReader) backoffDelay(runNum int) time.Duration {
+	delay := t.BackoffMin
+	for i := 1; i < runNum && delay < t.BackoffMax; i++ {
+		delay *= 2
 	}
+	delay = min(delay, t.BackoffMax)
 
-	return nil
+	jitter := 0.8 + 0.4*rand.Float64()
+	return time.Duration(float64(delay) * jitter)
 }
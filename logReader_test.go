@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLogSource struct {
+	lines    []string
+	opens    int
+	exitCode int
+}
+
+func (t *fakeLogSource) Open() error {
+	t.opens++
+	return nil
+}
+
+func (t *fakeLogSource) ReadLine() (*LogSourceLine, error) {
+	if len(t.lines) == 0 {
+		return nil, errors.Join(errors.New("producer failed"), io.ErrUnexpectedEOF)
+	}
+	line := t.lines[0]
+	t.lines = t.lines[1:]
+	return &LogSourceLine{Text: line}, nil
+}
+
+func (t *fakeLogSource) Close() error {
+	return nil
+}
+
+func (t *fakeLogSource) LastExitCode() int {
+	return t.exitCode
+}
+
+func TestLogReaderRestartLimit(t *testing.T) {
+	source := &fakeLogSource{lines: []string{readFileToString("test/data/log-line-request.txt")}, exitCode: 3}
+	reader := Must1(NewLogReader(LogReaderParams{
+		Name:                "test",
+		Source:              source,
+		ProcessRestartLimit: 2,
+		BackoffMin:          time.Millisecond,
+		BackoffMax:          2 * time.Millisecond,
+	}))
+
+	logCh := make(chan *LogLineData, 10)
+	reader.ReadLogStreamToChannel(context.Background(), logCh)
+
+	assert.Len(t, logCh, 1)
+	assert.Equal(t, "test", (<-logCh).Source)
+	assert.Equal(t, 3, source.opens)
+
+	state := reader.State()
+	assert.Equal(t, LogReaderStatusDead, state.Status)
+	assert.Equal(t, 2, state.Restarts)
+	assert.Equal(t, 3, state.LastExitCode)
+	assert.Contains(t, state.LastError, "producer failed")
+}
+
+func TestLogReaderBackoffDelay(t *testing.T) {
+	reader := &LogReader{LogReaderParams: LogReaderParams{BackoffMin: time.Second, BackoffMax: 10 * time.Second}}
+	for runNum, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 10 * time.Second} {
+		delay := reader.backoffDelay(runNum)
+		assert.GreaterOrEqual(t, delay, expected*8/10)
+		assert.LessOrEqual(t, delay, expected*12/10)
+	}
+}
+
+type blockingLogSource struct {
+	lines chan string
+	done  chan struct{}
+}
+
+func (t *blockingLogSource) Open() error {
+	return nil
+}
+
+func (t *blockingLogSource) ReadLine() (*LogSourceLine, error) {
+	select {
+	case line := <-t.lines:
+		return &LogSourceLine{Text: line, StateKey: "TestState", State: line}, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *blockingLogSource) Close() error {
+	close(t.done)
+	return nil
+}
+
+func TestLogReaderCancel(t *testing.T) {
+	source := &blockingLogSource{lines: make(chan string, 1), done: make(chan struct{})}
+	reader := Must1(NewLogReader(LogReaderParams{Name: "test", Source: source}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logCh := make(chan *LogLineData, 10)
+	finished := make(chan struct{})
+	go func() {
+		reader.ReadLogStreamToChannel(ctx, logCh)
+		close(finished)
+	}()
+
+	source.lines <- "FOO"
+	assert.Equal(t, "FOO", (<-logCh).SourceState)
+	assert.True(t, reader.IsAlive())
+
+	cancel()
+	<-finished
+	assert.Equal(t, LogReaderStatusStopped, reader.State().Status)
+	assert.False(t, reader.IsAlive())
+}
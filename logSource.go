@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogSource produces raw log lines for LogReader.
+// ReadLine returns io.EOF when the source is exhausted, after that Open can be called again to restart it.
+// Close stops the source for good, it can be called concurrently with ReadLine to interrupt it.
+type LogSource interface {
+	Open() error
+	ReadLine() (*LogSourceLine, error)
+	Close() error
+}
+
+// ProcessLogSource is implemented by sources that run a log producer process
+type ProcessLogSource interface {
+	LastExitCode() int
+}
+
+// LogSourceLine is a raw line with the source state to persist after the line is stored
+type LogSourceLine struct {
+	Text     string
+	Format   LogFormat
+	StateKey string
+	State    string
+}
+
+type CommandLogSourceParams struct {
+	Name               string
+	LogProducerCommand string
+	ExecDir            string
+	LastHandledTime    time.Time
+	// Journal enables `journalctl -o json` output and resuming with --after-cursor
+	Journal  bool
+	StateKey string
+	Cursor   string
+}
+
+var ErrLogSourceClosed = errors.New("log source is closed")
+
+type CommandLogSource struct {
+	CommandLogSourceParams
+	cmd          *exec.Cmd
+	scanner      *bufio.Scanner
+	stderrDone   chan struct{}
+	lastExitCode atomic.Int64
+	// lock guards the fields that are used by Close
+	lock    sync.Mutex
+	closed  bool
+	process *os.Process
+	stdout  io.ReadCloser
+}
+
+func NewCommandLogSource(params CommandLogSourceParams) (*CommandLogSource, error) {
+	if params.LogProducerCommand == "" {
+		params.LogProducerCommand = "sudo journalctl -fu dumbproxy.service"
+	}
+	if params.Journal && params.StateKey == "" {
+		params.StateKey = "JournalCursor"
+	}
+	return &CommandLogSource{CommandLogSourceParams: params}, nil
+}
+
+func (t *CommandLogSource) Open() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrLogSourceClosed
+	}
+
+	cmdParts := t.commandLine()
+	log.Infof("Launching log process: %v", cmdParts)
+
+	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
+	cmd.Dir = t.ExecDir
+	cmd.Env = append(os.Environ(), "IN_LOG_READER=1")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	t.cmd = cmd
+	t.scanner = nil
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	t.process = cmd.Process
+	t.stdout = stdout
+	t.scanner = bufio.NewScanner(stdout)
+	t.stderrDone = make(chan struct{})
+	go t.logStderr(stderr, t.stderrDone)
+
+	return nil
+}
+
+// commandLine is the producer command with the position to resume from.
+// journalctl reads --since without a zone as the local time, and the handled time is kept in UTC.
+func (t *CommandLogSource) commandLine() []string {
+	cmdParts := strings.Split(t.LogProducerCommand, " ")
+	if t.Journal {
+		cmdParts = append(cmdParts, "-o", "json")
+	}
+	if t.Journal && t.Cursor != "" {
+		cmdParts = append(cmdParts, "--after-cursor", t.Cursor)
+	} else {
+		cmdParts = append(cmdParts, "--since", t.LastHandledTime.Local().Format("2006-01-02 15:04:05"))
+	}
+	return cmdParts
+}
+
+func (t *CommandLogSource) LastExitCode() int {
+	return int(t.lastExitCode.Load())
+}
+
+// logStderr copies the producer stderr to our log
+func (t *CommandLogSource) logStderr(stderr io.Reader, done chan struct{}) {
+	defer close(done)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Warnf("Log process %s stderr: %s", t.Name, scanner.Text())
+	}
+}
+
+func (t *CommandLogSource) ReadLine() (*LogSourceLine, error) {
+	if t.scanner == nil {
+		return nil, errors.New("command log source is not opened")
+	}
+
+	if t.scanner.Scan() {
+		t.LastHandledTime = time.Now()
+		if t.Journal {
+			return t.journalLine(t.scanner.Text())
+		}
+		return &LogSourceLine{Text: t.scanner.Text()}, nil
+	}
+
+	if err := t.scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Warnf("Scanner close error: %s", err)
+	}
+
+	select {
+	case <-t.stderrDone:
+	case <-time.After(time.Second):
+	}
+	waitErr := t.cmd.Wait()
+	t.lastExitCode.Store(int64(t.cmd.ProcessState.ExitCode()))
+	t.scanner = nil
+
+	t.lock.Lock()
+	t.process = nil
+	t.stdout = nil
+	t.lock.Unlock()
+
+	if waitErr != nil {
+		return nil, errors.Join(fmt.Errorf("log process %s exited", t.Name), waitErr)
+	}
+	return nil, io.EOF
+}
+
+// Close asks the producer to terminate and kills it if it doesn't exit in time.
+// The process is reaped by ReadLine.
+func (t *CommandLogSource) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+
+	var resErr error
+	if t.process != nil {
+		process := t.process
+		if err := process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			resErr = multierror.Append(resErr, err)
+		}
+		time.AfterFunc(5*time.Second, func() {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			if t.process == process {
+				log.Warnf("Log process %s didn't exit on SIGTERM, killing it", t.Name)
+				WarnIfErr(process.Kill())
+			}
+		})
+	}
+
+	if t.stdout != nil {
+		if err := t.stdout.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			resErr = multierror.Append(resErr, err)
+		}
+	}
+
+	return resErr
+}
+
+func (t *CommandLogSource) journalLine(jsonLine string) (*LogSourceLine, error) {
+	entry, err := ParseJournalEntry(jsonLine)
+	if err != nil {
+		log.Warnf("Unable to parse journal record: %s", err)
+		return &LogSourceLine{Text: jsonLine, Format: LogFormatJournalJson}, nil
+	}
+
+	t.Cursor = entry.Cursor
+	return &LogSourceLine{Text: jsonLine, Format: LogFormatJournalJson, StateKey: t.StateKey, State: entry.Cursor}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+const DefaultSourceName = "default"
+
+var sourceNameRe = regexp.MustCompile("^[\\w.@-]+$")
+
+// LogSourceConfig describes one log source of the sources config
+type LogSourceConfig struct {
+	Name string
+	// Type is one of command, file or syslog
+	Type string
+	// Command and Dir are used by command sources
+	Command string
+	Dir     string
+	// Path is used by file sources
+	Path string
+	// Listen and Proto are used by syslog sources
+	Listen string
+	Proto  string
+	// Timezone of the log times without an offset like Europe/Amsterdam, the system timezone by default
+	Timezone string
+}
+
+func LoadLogSourceConfigs(configPath string) ([]LogSourceConfig, error) {
+	confFp, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sources config file: %s", err)
+	}
+	defer CloseOrWarn(confFp)
+
+	confContent, err := io.ReadAll(confFp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sources config file: %s", err)
+	}
+
+	var configs []LogSourceConfig
+	if err := json.Unmarshal(confContent, &configs); err != nil {
+		return nil, fmt.Errorf("unable to parse sources config: %s", err)
+	}
+
+	if err := ValidateLogSourceConfigs(configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func ValidateLogSourceConfigs(configs []LogSourceConfig) error {
+	if len(configs) == 0 {
+		return errors.New("no log sources are configured")
+	}
+
+	names := make(map[string]bool)
+	for _, conf := range configs {
+		if !sourceNameRe.MatchString(conf.Name) {
+			return fmt.Errorf("invalid log source name: %q", conf.Name)
+		}
+		if names[conf.Name] {
+			return fmt.Errorf("duplicate log source name: %s", conf.Name)
+		}
+		names[conf.Name] = true
+
+		if _, err := LoadLocation(conf.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone of log source %s: %s", conf.Name, err)
+		}
+
+		switch conf.Type {
+		case "command":
+			if conf.Command == "" {
+				return fmt.Errorf("command is required for log source %s", conf.Name)
+			}
+		case "file":
+			if conf.Path == "" {
+				return fmt.Errorf("path is required for log source %s", conf.Name)
+			}
+		case "syslog":
+			if conf.Listen == "" {
+				return fmt.Errorf("listen is required for log source %s", conf.Name)
+			}
+		default:
+			return fmt.Errorf("invalid type %q of log source %s", conf.Type, conf.Name)
+		}
+	}
+	return nil
+}
+
+// CreateLogSource creates a source restoring its resume state from the DB
+func CreateLogSource(conf LogSourceConfig, db *LogDb) (LogSource, error) {
+	switch conf.Type {
+	case "file":
+		stateKey := SourceStateKey(conf.Name, "FileSourceState")
+		state, err := db.GetKvStrRecord(stateKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileLogSource(FileLogSourceParams{
+			FilePath: conf.Path,
+			StateKey: stateKey,
+			State:    state,
+		})
+	case "syslog":
+		return NewSyslogLogSource(SyslogLogSourceParams{
+			Proto:      conf.Proto,
+			ListenAddr: conf.Listen,
+		})
+	case "command":
+		lastHandledTime, err := db.GetLastHandledTime(conf.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		isJournal := IsJournalCommand(conf.Command)
+		cursorKey := SourceStateKey(conf.Name, "JournalCursor")
+		cursor := ""
+		if isJournal {
+			if cursor, err = db.GetKvStrRecord(cursorKey); err != nil {
+				return nil, err
+			}
+		}
+
+		return NewCommandLogSource(CommandLogSourceParams{
+			Name:               conf.Name,
+			LogProducerCommand: conf.Command,
+			ExecDir:            conf.Dir,
+			LastHandledTime:    lastHandledTime,
+			Journal:            isJournal,
+			StateKey:           cursorKey,
+			Cursor:             cursor,
+		})
+	default:
+		return nil, fmt.Errorf("invalid type %q of log source %s", conf.Type, conf.Name)
+	}
+}
+
+// SourceStateKey returns KvData key for the source state.
+// The default source uses plain keys to keep the state of single source setups.
+func SourceStateKey(sourceName string, key string) string {
+	if sourceName == DefaultSourceName || sourceName == "" {
+		return key
+	}
+	return "Source:" + sourceName + ":" + key
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLogSourceConfigs(t *testing.T) {
+	commandConf := LogSourceConfig{Name: "main", Type: "command", Command: "journalctl -fu dumbproxy.service"}
+	fileConf := LogSourceConfig{Name: "file", Type: "file", Path: "/var/log/dumbproxy.log", Timezone: "Europe/Amsterdam"}
+	syslogConf := LogSourceConfig{Name: "syslog", Type: "syslog", Listen: ":5514", Proto: "udp"}
+	withConf := func(conf LogSourceConfig, update func(conf *LogSourceConfig)) LogSourceConfig {
+		update(&conf)
+		return conf
+	}
+
+	for _, tc := range []struct {
+		name    string
+		configs []LogSourceConfig
+		err     string
+	}{
+		{"valid", []LogSourceConfig{commandConf, fileConf, syslogConf}, ""},
+		{"empty", nil, "no log sources are configured"},
+		{"duplicate name", []LogSourceConfig{commandConf, withConf(fileConf, func(conf *LogSourceConfig) { conf.Name = "main" })}, "duplicate log source name: main"},
+		{"empty name", []LogSourceConfig{withConf(commandConf, func(conf *LogSourceConfig) { conf.Name = "" })}, `invalid log source name: ""`},
+		{"invalid name", []LogSourceConfig{withConf(commandConf, func(conf *LogSourceConfig) { conf.Name = "a:b" })}, `invalid log source name: "a:b"`},
+		{"missing type", []LogSourceConfig{withConf(commandConf, func(conf *LogSourceConfig) { conf.Type = "" })}, `invalid type "" of log source main`},
+		{"unknown type", []LogSourceConfig{withConf(commandConf, func(conf *LogSourceConfig) { conf.Type = "socket" })}, `invalid type "socket" of log source main`},
+		{"missing command", []LogSourceConfig{withConf(commandConf, func(conf *LogSourceConfig) { conf.Command = "" })}, "command is required for log source main"},
+		{"missing path", []LogSourceConfig{withConf(fileConf, func(conf *LogSourceConfig) { conf.Path = "" })}, "path is required for log source file"},
+		{"missing listen", []LogSourceConfig{withConf(syslogConf, func(conf *LogSourceConfig) { conf.Listen = "" })}, "listen is required for log source syslog"},
+		{"invalid timezone", []LogSourceConfig{withConf(fileConf, func(conf *LogSourceConfig) { conf.Timezone = "Mars/Olympus" })}, "invalid timezone of log source file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateLogSourceConfigs(tc.configs)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLoadLogSourceConfigs(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(name string, content string) string {
+		configPath := path.Join(dir, name)
+		Must0(os.WriteFile(configPath, []byte(content), 0644))
+		return configPath
+	}
+
+	configs := Must1(LoadLogSourceConfigs(writeConfig("valid.json", `[
+		{"Name": "default", "Type": "command", "Command": "journalctl -fu dumbproxy.service"},
+		{"Name": "edge", "Type": "file", "Path": "/var/log/dumbproxy.log", "Timezone": "UTC"}
+	]`)))
+	assert.Equal(t, []LogSourceConfig{
+		{Name: "default", Type: "command", Command: "journalctl -fu dumbproxy.service"},
+		{Name: "edge", Type: "file", Path: "/var/log/dumbproxy.log", Timezone: "UTC"},
+	}, configs)
+
+	for _, tc := range []struct {
+		name       string
+		configPath string
+		err        string
+	}{
+		{"missing file", path.Join(dir, "missing.json"), "unable to open sources config file"},
+		{"invalid JSON", writeConfig("invalid.json", `[{"Name": "default",`), "unable to parse sources config"},
+		{"duplicate name", writeConfig("duplicate.json", `[
+			{"Name": "edge", "Type": "syslog", "Listen": ":5514"},
+			{"Name": "edge", "Type": "syslog", "Listen": ":5515"}
+		]`), "duplicate log source name: edge"},
+		{"missing type", writeConfig("type.json", `[{"Name": "edge", "Path": "/var/log/dumbproxy.log"}]`), `invalid type "" of log source edge`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadLogSourceConfigs(tc.configPath)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestSourceStateKey(t *testing.T) {
+	for _, tc := range []struct {
+		sourceName string
+		key        string
+		expected   string
+	}{
+		// The default source keeps the keys of single source setups
+		{DefaultSourceName, "JournalCursor", "JournalCursor"},
+		{"", "JournalCursor", "JournalCursor"},
+		{DefaultSourceName, "LastLogTime", "LastLogTime"},
+		{"edge", "JournalCursor", "Source:edge:JournalCursor"},
+		{"edge", "FileSourceState", "Source:edge:FileSourceState"},
+	} {
+		assert.Equal(t, tc.expected, SourceStateKey(tc.sourceName, tc.key))
+	}
+
+	// The cursor stored by a single source setup is picked up by the default source
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+	Must0(db.SetKvRecord("JournalCursor", "s=legacy"))
+	Must0(db.SetKvRecord("Source:edge:JournalCursor", "s=edge"))
+	for sourceName, cursor := range map[string]string{DefaultSourceName: "s=legacy", "edge": "s=edge", "other": ""} {
+		conf := LogSourceConfig{Name: sourceName, Type: "command", Command: "journalctl -fu dumbproxy.service"}
+		src := Must1(CreateLogSource(conf, db)).(*CommandLogSource)
+		assert.Equal(t, cursor, src.Cursor, sourceName)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandLogSourceCommandLine(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+9", 9*60*60)
+
+	lastTime := time.Date(2024, 6, 18, 0, 7, 26, 0, time.UTC)
+	source := Must1(NewCommandLogSource(CommandLogSourceParams{LogProducerCommand: "journalctl -fu dumbproxy.service", LastHandledTime: lastTime}))
+	assert.Equal(t, []string{"journalctl", "-fu", "dumbproxy.service", "--since", "2024-06-18 09:07:26"}, source.commandLine())
+
+	source = Must1(NewCommandLogSource(CommandLogSourceParams{LogProducerCommand: "journalctl -fu dumbproxy.service", LastHandledTime: lastTime, Journal: true, Cursor: "s=1"}))
+	assert.Equal(t, []string{"journalctl", "-fu", "dumbproxy.service", "-o", "json", "--after-cursor", "s=1"}, source.commandLine())
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"html"
 	"os"
 	"os/signal"
 	"path"
@@ -17,23 +19,69 @@ import (
 )
 
 type cliArgs struct {
-	dbDir            string
-	logCmd           string
-	logCmdDir        string
-	reportTime       string
-	reportMail       string
-	mailerConfigPath string
+	dbDir         string
+	logCmd        string
+	logFile       string
+	syslogAddr    string
+	syslogProto   string
+	sourcesConfig string
+	reportSources string
+	alertMail     string
+	parserRules   string
+	proxyUnits    string
+	logTimezone   string
+	reportTz      string
+	retentionPath string
 
+	restartLimit       int
+	authAlertThreshold int
+	authAlertWindow    time.Duration
+	restartBackoffMin  time.Duration
+	restartBackoffMax  time.Duration
+	writeBatchSize     int
+	writeFlushInterval time.Duration
+	retention          time.Duration
+	vacuumInterval     time.Duration
+	maxLogDbSize       int64
+	hourlyRollupKeep   time.Duration
+	dailyRollupKeep    time.Duration
+	reportTrendDays    int
+	dnsCacheTtl        time.Duration
+	dnsNegativeTtl     time.Duration
+	logCmdDir          string
+	reportTime         string
+	reportMail         string
+	mailerConfigPath   string
+
+	reportLocation   *time.Location
 	reportHour       int
 	reportMinute     int
 	reportSecond     int
 	printReport      bool
+	archive          bool
+	proxyAuth        bool
 	scheduleInterval time.Duration
 }
 
 const MaxCacheItems = 10000
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		setupLogger()
+		runImport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		setupLogger()
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		setupLogger()
+		runRestore(os.Args[2:])
+		return
+	}
+
 	args := getArgs()
 	handleArgs(&args)
 	origLogLevel := setupLogger()
@@ -45,20 +93,61 @@ func main() {
 
 	db := Must1(NewLogDb(args.dbDir))
 	defer db.Close()
+	db.SetRollupLocation(args.reportLocation)
 
-	reader := Must1(NewLogReader(LogReaderParams{
-		LogProducerCommand: args.logCmd,
-		ExecDir:            args.logCmdDir,
-		LastHandledTime:    Must1(db.GetLastHandledTime()),
+	retentionParams := RetentionParams{
+		MaxAge:    args.retention,
+		MaxDbSize: args.maxLogDbSize * 1024 * 1024,
+	}
+	if args.archive {
+		retentionParams.ArchiveDir = path.Join(args.dbDir, ArchiveDirName)
+	}
+	if args.retentionPath != "" {
+		retentionParams.Rules = Must1(LoadRetentionRules(args.retentionPath))
+	}
+
+	parser := Must1(NewLogParser(LogParserParams{
+		RulesPath: args.parserRules,
+		Units:     splitList(args.proxyUnits),
+		ProxyAuth: args.proxyAuth,
 	}))
 
+	var readers []*LogReader
+	for _, sourceConfig := range getLogSourceConfigs(&args) {
+		readers = append(readers, Must1(NewLogReader(LogReaderParams{
+			Name:                sourceConfig.Name,
+			Source:              Must1(CreateLogSource(sourceConfig, db)),
+			Parser:              parser.WithLocation(Must1(LoadLocation(sourceConfig.Timezone))),
+			ProcessRestartLimit: args.restartLimit,
+			BackoffMin:          args.restartBackoffMin,
+			BackoffMax:          args.restartBackoffMax,
+		})))
+	}
+
 	scheduler := bgscheduler.MustCreateNewScheduler(&bgscheduler.Config{
 		Logger:       log.StandardLogger(),
 		LogLevel:     bgscheduler.LogLevel(log.StandardLogger().GetLevel()),
 		DbPath:       path.Join(args.dbDir, "scheduler.db"),
 		ScanInterval: args.scheduleInterval,
 	})
-	reporter := Must1(NewLogReporter(db))
+	getReaderStates := func() []LogReaderState {
+		var states []LogReaderState
+		for _, reader := range readers {
+			states = append(states, reader.State())
+		}
+		return states
+	}
+
+	reporter := Must1(NewLogReporter(db, LogReporterParams{
+		Sources:      splitList(args.reportSources),
+		ReaderStates: getReaderStates,
+		WriterStats:  db.WriterStats,
+		Location:     args.reportLocation,
+		TrendDays:    args.reportTrendDays,
+
+		DnsCacheTtl:         args.dnsCacheTtl,
+		DnsNegativeCacheTtl: args.dnsNegativeTtl,
+	}))
 
 	createReport := func() error {
 		report, err := reporter.GenerateReport()
@@ -67,12 +156,7 @@ func main() {
 		}
 
 		if mailer != nil {
-			hostname, err := os.Hostname()
-			if err != nil {
-				log.Warnf("Unable to get hostname: %s", err)
-				hostname = "Unknown host"
-			}
-			subject := hostname + ": Proxy usage report"
+			subject := getHostname() + ": Proxy usage report"
 			if err := mailer.SendMessage(args.reportMail, subject, report); err != nil {
 				return fmt.Errorf("unable to send email: %s", err)
 			}
@@ -86,22 +170,145 @@ func main() {
 		return nil
 	}
 
-	scheduler.MustScheduleExactTimeTask(
-		"CreateReport",
-		bgscheduler.ExactLaunchTime{
-			Hour:   args.reportHour,
-			Minute: args.reportMinute,
-			Second: args.reportSecond,
+	reportTime := bgscheduler.ExactLaunchTime{Hour: args.reportHour, Minute: args.reportMinute, Second: args.reportSecond}
+	reportLaunchTime := localLaunchTime(reportTime, args.reportLocation, time.Local, time.Now())
+	scheduler.MustScheduleExactTimeTask("CreateReport", reportLaunchTime, createReport)
+	if reportTime.Hour >= 0 {
+		// The scheduler works in the system timezone, so the report is moved when the offsets change for DST
+		scheduler.MustScheduleIntervalTask(
+			"ReportTimeUpdate",
+			time.Minute,
+			func() error {
+				launchTime := localLaunchTime(reportTime, args.reportLocation, time.Local, time.Now())
+				if launchTime.Equals(reportLaunchTime) {
+					return nil
+				}
+				log.Infof("Report launch time is moved to %02d:%02d:%02d of the system timezone", launchTime.Hour, launchTime.Minute, launchTime.Second)
+				scheduler.RemoveExactTimeTask("CreateReport")
+				scheduler.MustScheduleExactTimeTask("CreateReport", launchTime, createReport)
+				reportLaunchTime = launchTime
+				return nil
+			},
+		)
+	}
+
+	alertedReaders := make(map[string]bool)
+	scheduler.MustScheduleIntervalTask(
+		"LogReadersCheck",
+		time.Minute,
+		func() error {
+			for _, state := range getReaderStates() {
+				isDead := state.Status == LogReaderStatusDead
+				if !isDead || alertedReaders[state.Name] {
+					alertedReaders[state.Name] = isDead
+					continue
+				}
+				alertedReaders[state.Name] = true
+
+				log.Errorf("Log reader %s is dead, last exit code %d: %s", state.Name, state.LastExitCode, state.LastError)
+				if mailer != nil && args.alertMail != "" {
+					subject := getHostname() + ": Log reader " + state.Name + " is dead"
+					message := fmt.Sprintf(
+						"<p>Log reader <b>%s</b> is dead since %s after %d restarts.</p><p>Last exit code: %d</p><p>Last error: %s</p>",
+						html.EscapeString(state.Name),
+						state.Since.UTC().Format(time.RFC3339),
+						state.Restarts,
+						state.LastExitCode,
+						html.EscapeString(state.LastError),
+					)
+					if err := mailer.SendMessage(args.alertMail, subject, message); err != nil {
+						return fmt.Errorf("unable to send alert: %s", err)
+					}
+				}
+			}
+			return nil
+		},
+	)
+
+	if args.authAlertThreshold > 0 {
+		alertedAuthFailures := make(map[string]time.Time)
+		scheduler.MustScheduleIntervalTask(
+			"AuthFailuresCheck",
+			time.Minute,
+			func() error {
+				now := time.Now()
+				items, err := db.GetAuthFailuresAlertData(now.Add(-args.authAlertWindow), args.authAlertThreshold)
+				if err != nil {
+					return err
+				}
+
+				for _, item := range items {
+					key := item.Kind + ":" + item.Name
+					if alertedAt, ok := alertedAuthFailures[key]; ok && now.Sub(alertedAt) < args.authAlertWindow {
+						continue
+					}
+					alertedAuthFailures[key] = now
+
+					log.Warnf("Authentication failures for %s %s: %d during %s", item.Kind, item.Name, item.Failures, args.authAlertWindow)
+					if mailer != nil && args.alertMail != "" {
+						subject := getHostname() + ": Authentication failures for " + item.Kind + " " + item.Name
+						message := fmt.Sprintf(
+							"<p>%d authentication failures for %s <b>%s</b> during %s.</p>",
+							item.Failures,
+							item.Kind,
+							html.EscapeString(item.Name),
+							args.authAlertWindow,
+						)
+						if err := mailer.SendMessage(args.alertMail, subject, message); err != nil {
+							return fmt.Errorf("unable to send alert: %s", err)
+						}
+					}
+				}
+
+				for key, alertedAt := range alertedAuthFailures {
+					if now.Sub(alertedAt) >= args.authAlertWindow {
+						delete(alertedAuthFailures, key)
+					}
+				}
+				return nil
+			},
+		)
+	}
+
+	scheduler.MustScheduleIntervalTask(
+		"LogWriterStats",
+		time.Minute,
+		func() error {
+			stats := db.WriterStats()
+			log.Infof(
+				"Log writer stats: records %d (%.1f/s), duplicates %d, failed %d, batches %d, last batch %d in %s, queue %d, lag %s",
+				stats.Records,
+				stats.RecordsPerSecond(),
+				stats.Duplicates,
+				stats.FailedRecords,
+				stats.Batches,
+				stats.LastBatchSize,
+				stats.LastBatchDuration.Round(time.Microsecond),
+				stats.QueueLen,
+				stats.Lag.Round(time.Millisecond),
+			)
+			return nil
 		},
-		createReport,
+	)
+
+	scheduler.MustScheduleIntervalTask(
+		"LogRecordsRollup",
+		10*time.Minute,
+		db.RollupLogRecords,
 	)
 
 	scheduler.MustScheduleIntervalTask(
 		"LogRecordsVacuumClean",
-		time.Hour,
+		args.vacuumInterval,
 		func() error {
-			recsDeleted, err := db.LogRecordsVacuumClean(48 * time.Hour)
+			recsDeleted, err := db.LogRecordsVacuumClean(retentionParams)
 			log.Infof("Vacuum clean log records deleted: %d", recsDeleted)
+			if err != nil {
+				return err
+			}
+
+			rollupsDeleted, err := db.RollupsVacuumClean(args.hourlyRollupKeep, args.dailyRollupKeep)
+			log.Infof("Vacuum clean rollup buckets deleted: %d", rollupsDeleted)
 			return err
 		},
 	)
@@ -112,44 +319,66 @@ func main() {
 		func() error {
 			recsDeleted, err := db.CacheDataVacuumClean(MaxCacheItems)
 			log.Infof("Vacuum clean cache records deleted: %d", recsDeleted)
+			for _, stats := range db.CacheStats() {
+				log.Infof(
+					"Cache %s: memory hits %d, disk hits %d, misses %d, errors %d",
+					stats.Namespace,
+					stats.MemoryHits,
+					stats.DiskHits,
+					stats.Misses,
+					stats.Errors,
+				)
+			}
 			return err
 		},
 	)
 
+	ctx, stopCtx := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopCtx()
+
 	var workersGroup sync.WaitGroup
+	var readersGroup sync.WaitGroup
 	logChan := make(chan *LogLineData, 128)
+	for _, reader := range readers {
+		readersGroup.Add(1)
+		go func(reader *LogReader) {
+			defer readersGroup.Done()
+			reader.ReadLogStreamToChannel(ctx, logChan)
+		}(reader)
+	}
+
+	workersGroup.Add(4)
 	go func() {
-		reader.ReadLogStreamToChannel(logChan)
-		if err := db.SetLastHandledLogTimeNow(); err != nil {
-			log.Warnf("Unable to SetLastHandledLogTimeNow: %s", err)
-		}
-		workersGroup.Done()
+		defer workersGroup.Done()
+		readersGroup.Wait()
+		close(logChan)
 	}()
 	go func() {
-		db.WriteRecordsFromChannel(logChan)
-		workersGroup.Done()
+		defer workersGroup.Done()
+		db.WriteRecordsFromChannel(logChan, LogWriterParams{
+			BatchSize:     args.writeBatchSize,
+			FlushInterval: args.writeFlushInterval,
+		})
 	}()
 	go func() {
+		defer workersGroup.Done()
 		scheduler.Run(nil)
-		workersGroup.Done()
 		log.Info("Scheduler is finished")
 	}()
-	workersGroup.Add(3)
 
-	stopSignalChan := make(chan os.Signal, 1)
 	usrSignalChan := make(chan os.Signal, 2)
-	signal.Notify(stopSignalChan, syscall.SIGTERM, syscall.SIGINT)
 	signal.Notify(usrSignalChan, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	go func() {
-		sig := <-stopSignalChan
-		log.Infof("Stopping on signal %v", sig)
+		<-ctx.Done()
+		log.Info("Stopping on signal")
+		signal.Stop(usrSignalChan)
 		close(usrSignalChan)
-		reader.Stop()
 		scheduler.Close()
 	}()
 
 	go func() {
+		defer workersGroup.Done()
 		for sig := range usrSignalChan {
 			switch sig {
 			case syscall.SIGUSR1:
@@ -175,6 +404,62 @@ func main() {
 	log.Info("Work is finished")
 }
 
+func getLogSourceConfigs(args *cliArgs) []LogSourceConfig {
+	if args.sourcesConfig != "" {
+		return Must1(LoadLogSourceConfigs(args.sourcesConfig))
+	}
+
+	conf := LogSourceConfig{Name: DefaultSourceName, Timezone: args.logTimezone}
+	switch {
+	case args.logFile != "":
+		conf.Type = "file"
+		conf.Path = args.logFile
+	case args.syslogAddr != "":
+		conf.Type = "syslog"
+		conf.Listen = args.syslogAddr
+		conf.Proto = args.syslogProto
+	default:
+		conf.Type = "command"
+		conf.Command = args.logCmd
+		conf.Dir = args.logCmdDir
+	}
+	return []LogSourceConfig{conf}
+}
+
+// localLaunchTime converts the next daily launch time in the location to the timezone local used by the scheduler.
+// The result changes with the offset of the location or local for DST, so it's recomputed while running.
+// Negative hours mean hourly or minutely launches that don't depend on the timezone.
+func localLaunchTime(launchTime bgscheduler.ExactLaunchTime, location *time.Location, local *time.Location, now time.Time) bgscheduler.ExactLaunchTime {
+	if launchTime.Hour < 0 {
+		return launchTime
+	}
+
+	now = now.In(location)
+	nextLaunch := time.Date(now.Year(), now.Month(), now.Day(), launchTime.Hour, max(launchTime.Minute, 0), max(launchTime.Second, 0), 0, location)
+	if nextLaunch.Before(now) {
+		nextLaunch = time.Date(now.Year(), now.Month(), now.Day()+1, launchTime.Hour, max(launchTime.Minute, 0), max(launchTime.Second, 0), 0, location)
+	}
+	nextLaunch = nextLaunch.In(local)
+
+	res := bgscheduler.ExactLaunchTime{Hour: nextLaunch.Hour(), Minute: nextLaunch.Minute(), Second: nextLaunch.Second()}
+	if launchTime.Minute < 0 {
+		res.Minute = launchTime.Minute
+	}
+	if launchTime.Second < 0 {
+		res.Second = launchTime.Second
+	}
+	return res
+}
+
+func getHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Unable to get hostname: %s", err)
+		hostname = "Unknown host"
+	}
+	return hostname
+}
+
 func setupLogger() log.Level {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:          true,
@@ -199,8 +484,36 @@ func getArgs() cliArgs {
 	flag.StringVar(&args.dbDir, "dbDir", "/tmp/dumbproxy-log-monitor-test-db", "DB directory")
 	flag.StringVar(&args.logCmd, "logCmd", "sudo journalctl -fu dumbproxy.service", "CMD for logs")
 	flag.StringVar(&args.logCmdDir, "logCmdDir", ".", "CWD for log CMD")
-	flag.StringVar(&args.reportTime, "reportTime", "22:00:00", "Report UTC time in format 22:00:00")
+	flag.StringVar(&args.logFile, "logFile", "", "Log file to follow instead of -logCmd")
+	flag.StringVar(&args.syslogAddr, "syslogAddr", "", "Address like :5514 to receive syslog messages on instead of -logCmd")
+	flag.StringVar(&args.syslogProto, "syslogProto", "both", "Protocol for -syslogAddr: udp, tcp or both")
+	flag.StringVar(&args.sourcesConfig, "sourcesConfig", "", "JSON config with several named log sources, overrides -logCmd, -logFile and -syslogAddr")
+	flag.StringVar(&args.parserRules, "parserRules", "", "JSON file with log parser rules, built-in rules by default")
+	flag.StringVar(&args.proxyUnits, "proxyUnits", "", "Comma separated dumbproxy unit globs like dumbproxy@* or regexes starting with ^, overrides units of -parserRules")
+	flag.BoolVar(&args.proxyAuth, "proxyAuth", false, "dumbproxy requires authentication, so its requests without a user are counted as authentication failures")
+	flag.StringVar(&args.reportSources, "reportSources", "", "Comma separated log sources to include into the report, all by default")
+	flag.StringVar(&args.reportTime, "reportTime", "22:00:00", "Report time in -reportTimezone in format 22:00:00")
+	flag.StringVar(&args.reportTz, "reportTimezone", "UTC", "Timezone like Europe/Amsterdam of -reportTime and the report times, Local for the system timezone")
+	flag.StringVar(&args.logTimezone, "logTimezone", "", "Timezone like Europe/Amsterdam of the log times without an offset, the system timezone by default")
 	flag.StringVar(&args.reportMail, "reportMail", "", "Email to send reports")
+	flag.StringVar(&args.alertMail, "alertMail", "", "Email to send alerts about dead log readers and authentication failures, -reportMail by default")
+	flag.IntVar(&args.authAlertThreshold, "authAlertThreshold", 0, "Authentication failures of one user or source IP during -authAlertWindow to send an alert, 0 disables alerts")
+	flag.DurationVar(&args.authAlertWindow, "authAlertWindow", 10*time.Minute, "Window for -authAlertThreshold")
+	flag.IntVar(&args.restartLimit, "restartLimit", 3, "Consecutive log reader restarts before giving up, negative for unlimited")
+	flag.DurationVar(&args.restartBackoffMin, "restartBackoffMin", 2*time.Second, "Initial delay before log reader restart")
+	flag.DurationVar(&args.restartBackoffMax, "restartBackoffMax", 5*time.Minute, "Max delay before log reader restart")
+	flag.IntVar(&args.writeBatchSize, "writeBatchSize", 500, "Max log records in one insert transaction")
+	flag.DurationVar(&args.writeFlushInterval, "writeFlushInterval", 200*time.Millisecond, "Max delay before log records are written to the DB")
+	flag.DurationVar(&args.retention, "retention", 48*time.Hour, "How long log records are kept when no rule of -retentionRules matches them")
+	flag.StringVar(&args.retentionPath, "retentionRules", "", "JSON file with retention rules by line type, source and error flag")
+	flag.Int64Var(&args.maxLogDbSize, "maxLogDbSize", 0, "Max size of log.db with its WAL in MB, the oldest log records are deleted above it, 0 disables the cap")
+	flag.BoolVar(&args.archive, "archive", false, "Archive deleted log records to gzipped JSON lines in the archive dir of -dbDir")
+	flag.DurationVar(&args.vacuumInterval, "vacuumInterval", time.Hour, "Interval of deleting expired log records")
+	flag.DurationVar(&args.hourlyRollupKeep, "hourlyRollupRetention", 90*24*time.Hour, "How long hourly rollups of the log records are kept")
+	flag.DurationVar(&args.dailyRollupKeep, "dailyRollupRetention", 2*365*24*time.Hour, "How long daily rollups of the log records are kept")
+	flag.IntVar(&args.reportTrendDays, "reportTrendDays", 30, "Days of the long-term stats in the report, 0 hides them")
+	flag.DurationVar(&args.dnsCacheTtl, "dnsCacheTtl", 24*time.Hour, "How long resolved domains of the src IPs are cached")
+	flag.DurationVar(&args.dnsNegativeTtl, "dnsNegativeCacheTtl", time.Hour, "How long src IPs without domains are cached before the next lookup")
 	flag.DurationVar(&args.scheduleInterval, "scheduleInterval", time.Second, "Interval for scheduler tasks scan")
 	flag.StringVar(&args.mailerConfigPath, "mailerConfig", "secrets/mailer.json", "Config for mailer")
 	flag.BoolVar(&args.printReport, "printReport", false, "Print report to STDOUT")
@@ -213,8 +526,12 @@ func handleArgs(args *cliArgs) {
 		log.Fatalln("-dbDir is required")
 	}
 
-	if args.logCmd == "" {
-		log.Fatalln("-logCmd is required")
+	if args.alertMail == "" {
+		args.alertMail = args.reportMail
+	}
+
+	if args.logCmd == "" && args.logFile == "" && args.syslogAddr == "" && args.sourcesConfig == "" {
+		log.Fatalln("-logCmd, -logFile, -syslogAddr or -sourcesConfig is required")
 	}
 
 	matches := Must1(regexp.Compile("^(-?\\d{1,2}):(-?\\d{1,2}):(-?\\d{1,2})$")).FindStringSubmatch(args.reportTime)
@@ -225,6 +542,30 @@ func handleArgs(args *cliArgs) {
 	args.reportMinute = Must1(strconv.Atoi(matches[2]))
 	args.reportSecond = Must1(strconv.Atoi(matches[3]))
 
+	var err error
+	if args.reportLocation, err = LoadLocation(args.reportTz); err != nil {
+		log.Fatalf("Invalid value for -reportTimezone: %s", err)
+	}
+	if _, err := LoadLocation(args.logTimezone); err != nil {
+		log.Fatalf("Invalid value for -logTimezone: %s", err)
+	}
+
+	if args.retention <= 0 || args.vacuumInterval <= 0 {
+		log.Fatalln("-retention and -vacuumInterval should be positive")
+	}
+	if args.maxLogDbSize < 0 {
+		log.Fatalln("-maxLogDbSize should not be negative")
+	}
+	if args.hourlyRollupKeep <= 0 || args.dailyRollupKeep <= 0 {
+		log.Fatalln("-hourlyRollupRetention and -dailyRollupRetention should be positive")
+	}
+	if args.reportTrendDays < 0 {
+		log.Fatalln("-reportTrendDays should not be negative")
+	}
+	if args.dnsCacheTtl <= 0 || args.dnsNegativeTtl <= 0 {
+		log.Fatalln("-dnsCacheTtl and -dnsNegativeCacheTtl should be positive")
+	}
+
 	if _, err := os.Stat(args.mailerConfigPath); err != nil {
 		log.Fatalf("Unable to read -mailerConfig: %s", err)
 	}
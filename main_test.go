@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	bgscheduler "github.com/andre487/go-background-task-scheduler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalLaunchTime(t *testing.T) {
+	amsterdam := Must1(time.LoadLocation("Europe/Amsterdam"))
+	newYork := Must1(time.LoadLocation("America/New_York"))
+	reportTime := bgscheduler.ExactLaunchTime{Hour: 22, Minute: 30, Second: 0}
+
+	for _, tc := range []struct {
+		name       string
+		launchTime bgscheduler.ExactLaunchTime
+		location   *time.Location
+		local      *time.Location
+		now        time.Time
+		expected   bgscheduler.ExactLaunchTime
+	}{
+		{"winter", reportTime, amsterdam, time.UTC, time.Date(2024, time.March, 30, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 21, Minute: 30}},
+		{"summer", reportTime, amsterdam, time.UTC, time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 20, Minute: 30}},
+		// After the launch of the day before the switch the next launch is already in summer time
+		{"before DST start", reportTime, amsterdam, time.UTC, time.Date(2024, time.March, 30, 22, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 20, Minute: 30}},
+		{"after DST end", reportTime, amsterdam, time.UTC, time.Date(2024, time.October, 27, 2, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 21, Minute: 30}},
+		// The system timezone switches to summer time on another date
+		{"different switch dates", reportTime, amsterdam, newYork, time.Date(2024, time.March, 20, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 17, Minute: 30}},
+		{"same offsets", reportTime, amsterdam, newYork, time.Date(2024, time.April, 10, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 16, Minute: 30}},
+		{"minutely", bgscheduler.ExactLaunchTime{Hour: 22, Minute: -1, Second: 15}, amsterdam, time.UTC, time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: 20, Minute: -1, Second: 15}},
+		{"hourly", bgscheduler.ExactLaunchTime{Hour: -1, Minute: 30, Second: 0}, amsterdam, time.UTC, time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC), bgscheduler.ExactLaunchTime{Hour: -1, Minute: 30}},
+	} {
+		assert.Equal(t, tc.expected, localLaunchTime(tc.launchTime, tc.location, tc.local, tc.now), tc.name)
+	}
+}
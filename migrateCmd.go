@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type migrateArgs struct {
+	dbDir  string
+	dryRun bool
+}
+
+// runMigrate applies the pending schema migrations, or only prints them with -dryRun
+func runMigrate(argv []string) {
+	args := getMigrateArgs(argv)
+
+	// The dry run must not change the DBs, so it doesn't create missing files or switch them to WAL
+	var db *LogDb
+	var err error
+	if args.dryRun {
+		db, err = OpenLogDbReadOnly(args.dbDir)
+	} else {
+		db, err = OpenLogDb(args.dbDir)
+	}
+	if err != nil {
+		log.Fatalf("Unable to open DBs: %s", err)
+	}
+	defer db.Close()
+
+	pending := Must1(db.PendingMigrations())
+	if len(pending) == 0 {
+		fmt.Println("Schema is up to date")
+		return
+	}
+
+	if args.dryRun {
+		fmt.Printf("Pending migrations: %d\n", len(pending))
+		for _, migration := range pending {
+			fmt.Println(migration)
+			for _, step := range migration.Steps {
+				fmt.Printf("    %s\n", step)
+			}
+		}
+		return
+	}
+
+	applied, err := db.Migrate()
+	for _, migration := range applied {
+		fmt.Printf("Applied %s\n", migration)
+	}
+	if err != nil {
+		log.Fatalf("Migration failed: %s", err)
+	}
+	fmt.Printf("Migrations applied: %d\n", len(applied))
+}
+
+func getMigrateArgs(argv []string) migrateArgs {
+	var args migrateArgs
+	flagSet := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flagSet.StringVar(&args.dbDir, "dbDir", "/tmp/dumbproxy-log-monitor-test-db", "DB directory")
+	flagSet.BoolVar(&args.dryRun, "dryRun", false, "Print pending migrations and their statements without applying them")
+	Must0(flagSet.Parse(argv))
+
+	return args
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// MigrationTimeout limits one migration, backfills of big DBs take much longer than usual queries
+const MigrationTimeout = 30 * time.Minute
+
+// BackupDirName is the directory in dbDir for DB copies taken before migrations
+const BackupDirName = "backup"
+
+// MaxDbBackups is the number of the latest backups kept for every DB, older ones are deleted after a new backup
+const MaxDbBackups = 3
+
+// backupTimeFormat is the suffix of backup names, so the names of one DB sort by time after it
+const backupTimeFormat = "20060102T150405Z"
+
+type schemaMigration struct {
+	Version     int
+	Description string
+	// AddColumns are added only when missing: DBs of the unversioned schema may already have some of them
+	AddColumns []tableColumn
+	Queries    []string
+	// Apply is an optional step after the queries, ApplyDescription is shown by the dry run
+	Apply            func(ctx context.Context, tx *sqlx.Tx) error
+	ApplyDescription string
+}
+
+type tableColumn struct {
+	Table      string
+	Name       string
+	Definition string
+}
+
+// PendingMigration is a migration that isn't applied to a DB yet with the steps it's going to execute
+type PendingMigration struct {
+	DbName      string
+	Version     int
+	Description string
+	Steps       []string
+}
+
+func (t PendingMigration) String() string {
+	return fmt.Sprintf("%s v%d: %s", t.DbName, t.Version, t.Description)
+}
+
+type schemaDb struct {
+	Name       string
+	Db         *sqlx.DB
+	Migrations []schemaMigration
+}
+
+// Migrations are applied in order, and every applied version is kept in the SchemaMigrations table of its DB.
+// Never change an applied migration, add a new one instead.
+var logDbMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "Create LogRecords",
+		Queries: []string{
+			`CREATE TABLE IF NOT EXISTS LogRecords (
+				Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				Ts INTEGER NOT NULL,
+				LogLineType TEXT NOT NULL,
+				LogLine TEXT NOT NULL,
+				LogTime INTEGER NOT NULL,
+				IsError INTEGER NOT NULL,
+				HasRequestInfo INTEGER NOT NULL,
+				Host TEXT NOT NULL,
+				Pid INTEGER NOT NULL,
+				FileName TEXT NOT NULL,
+				FileLine TEXT NOT NULL,
+				SrcIp TEXT NOT NULL,
+				DestIp TEXT NOT NULL,
+				DestPort INTEGER NOT NULL,
+				Username TEXT NOT NULL,
+				Proto TEXT NOT NULL,
+				Method TEXT NOT NULL,
+				Url TEXT NOT NULL,
+				Status INTEGER NOT NULL,
+				ErrorMessage TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS Id_LogLineType ON LogRecords (Id, LogLineType)`,
+			`CREATE INDEX IF NOT EXISTS Ts ON LogRecords (Ts)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add log sources and record fingerprints",
+		AddColumns: []tableColumn{
+			{"LogRecords", "Source", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "Fingerprint", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "Instance", `TEXT NOT NULL DEFAULT ""`},
+		},
+		Queries: []string{
+			`CREATE INDEX IF NOT EXISTS Source ON LogRecords (Source)`,
+			`CREATE INDEX IF NOT EXISTS Source_Instance ON LogRecords (Source, Instance)`,
+			`CREATE INDEX IF NOT EXISTS Fingerprint_Ts ON LogRecords (Fingerprint, Ts)`,
+		},
+		// Old records keep empty fingerprints: the sources fingerprint new records by positions
+		// that the old records don't have, and new sources have no old records to compare with
+	},
+	{
+		Version:     3,
+		Description: "Add upstream error and auth details",
+		AddColumns: []tableColumn{
+			{"LogRecords", "AddrFamily", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "UpstreamOp", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "ErrorClass", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "SrcPort", `INTEGER NOT NULL DEFAULT 0`},
+			{"LogRecords", "ErrorReason", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "AuthOutcome", `TEXT NOT NULL DEFAULT ""`},
+		},
+		Queries: []string{
+			`CREATE INDEX IF NOT EXISTS AuthOutcome_LogTime ON LogRecords (AuthOutcome, LogTime)`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Create ProxyRequests",
+		Queries: []string{
+			`CREATE TABLE IF NOT EXISTS ProxyRequests (
+				Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+				Ts INTEGER NOT NULL,
+				Source TEXT NOT NULL,
+				Instance TEXT NOT NULL,
+				Host TEXT NOT NULL,
+				Pid INTEGER NOT NULL,
+				SrcIp TEXT NOT NULL,
+				SrcPort INTEGER NOT NULL,
+				Username TEXT NOT NULL DEFAULT "",
+				DestIp TEXT NOT NULL DEFAULT "",
+				DestPort INTEGER NOT NULL DEFAULT 0,
+				Proto TEXT NOT NULL DEFAULT "",
+				Method TEXT NOT NULL DEFAULT "",
+				Url TEXT NOT NULL DEFAULT "",
+				Status INTEGER NOT NULL DEFAULT 0,
+				StartTime INTEGER NOT NULL,
+				EndTime INTEGER NOT NULL DEFAULT 0,
+				RequestRecordId INTEGER NOT NULL DEFAULT 0,
+				HttpInfoRecordId INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX IF NOT EXISTS ProxyRequests_Connection ON ProxyRequests (Source, Host, Pid, SrcIp, SrcPort, StartTime)`,
+			`CREATE INDEX IF NOT EXISTS ProxyRequests_HttpInfoRecordId ON ProxyRequests (HttpInfoRecordId)`,
+			`CREATE INDEX IF NOT EXISTS ProxyRequests_Ts ON ProxyRequests (Ts)`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "Add request URL parts",
+		AddColumns: []tableColumn{
+			{"LogRecords", "UrlScheme", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "UrlHost", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "UrlPort", `INTEGER NOT NULL DEFAULT 0`},
+			{"LogRecords", "UrlPath", `TEXT NOT NULL DEFAULT ""`},
+			{"LogRecords", "SiteDomain", `TEXT NOT NULL DEFAULT ""`},
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add microsecond log times",
+		AddColumns: []tableColumn{
+			{"LogRecords", "LogTimeUs", `INTEGER NOT NULL DEFAULT 0`},
+		},
+		Queries: []string{
+			`UPDATE LogRecords SET LogTimeUs = LogTime * 1000000 WHERE LogTimeUs == 0`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "Add line templates",
+		AddColumns: []tableColumn{
+			{"LogRecords", "LineTemplate", `TEXT NOT NULL DEFAULT ""`},
+		},
+	},
+	{
+		Version:     8,
+		Description: "Create hourly and daily rollups",
+		Queries: []string{
+			rollupTableQuery("HourlyRollups"),
+			rollupTableQuery("DailyRollups"),
+			`CREATE INDEX IF NOT EXISTS HourlyRollups_BucketTs ON HourlyRollups (BucketTs)`,
+			`CREATE INDEX IF NOT EXISTS DailyRollups_BucketTs ON DailyRollups (BucketTs)`,
+			`CREATE TABLE IF NOT EXISTS RollupState (
+				Name TEXT NOT NULL PRIMARY KEY,
+				Value INTEGER NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "Index the last log times of sources for duplicate checks",
+		Queries: []string{
+			`CREATE INDEX IF NOT EXISTS Source_LogTimeUs ON LogRecords (Source, LogTimeUs)`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "Relabel MAIN records stored as HTTPSRV errors",
+		// LogLineTypeRuntimeLog was named LogLineTypeHttpSrvError before, the lines of the MAIN logger tell them apart
+		Queries: []string{
+			`UPDATE LogRecords SET LogLineType = "LogLineTypeRuntimeLog" WHERE LogLineType == "LogLineTypeHttpSrvError" AND LogLine GLOB "*]: MAIN *"`,
+		},
+	},
+	{
+		Version:          11,
+		Description:      "Reclassify TLS handshake errors stored as HTTPSRV errors",
+		Apply:            reclassifyTlsHandshakeErrors,
+		ApplyDescription: "parse the stored HTTPSRV TLS handshake errors again and set their type, client address and reason",
+	},
+	{
+		Version:     12,
+		Description: "Relabel proxy auth failures stored as requests",
+		// requestAuthFailure stored its lines as LogLineTypeProxyRequest before, and they were joined into ProxyRequests
+		Queries: []string{
+			`DELETE FROM ProxyRequests WHERE RequestRecordId IN (
+				SELECT Id FROM LogRecords WHERE LogLineType == "LogLineTypeProxyRequest" AND AuthOutcome == "failure"
+			)`,
+			`UPDATE LogRecords SET LogLineType = "LogLineTypeProxyAuthFailure" WHERE LogLineType == "LogLineTypeProxyRequest" AND AuthOutcome == "failure"`,
+		},
+	},
+}
+
+var kvDbMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "Create KvData",
+		Queries: []string{
+			`CREATE TABLE IF NOT EXISTS KvData (
+				Name TEXT NOT NULL PRIMARY KEY,
+				Value TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Drop the unversioned SchemaVersion record",
+		Queries: []string{
+			`DELETE FROM KvData WHERE Name == "SchemaVersion"`,
+		},
+	},
+}
+
+var cacheDbMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "Create CacheData",
+		Queries: []string{
+			`CREATE TABLE IF NOT EXISTS CacheData (
+				Key TEXT NOT NULL PRIMARY KEY,
+				Value TEXT NOT NULL,
+				ExpiresTs INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS ExpiresTs ON CacheData (ExpiresTs)`,
+			`CREATE INDEX IF NOT EXISTS Key_ExpiresTs ON CacheData (Key, ExpiresTs)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add cache namespaces and negative results",
+		AddColumns: []tableColumn{
+			{"CacheData", "Namespace", `TEXT NOT NULL DEFAULT ""`},
+			{"CacheData", "Negative", `INTEGER NOT NULL DEFAULT 0`},
+		},
+		// The keys of the items without a namespace have no namespace prefix, so they are never read
+		Queries: []string{
+			`DELETE FROM CacheData WHERE Namespace == ""`,
+		},
+	},
+}
+
+func (t *LogDb) schemaDbs() []schemaDb {
+	return []schemaDb{
+		{Name: "log.db", Db: t.logDb, Migrations: logDbMigrations},
+		{Name: "kv.db", Db: t.kvDb, Migrations: kvDbMigrations},
+		{Name: "cache.db", Db: t.cacheDb, Migrations: cacheDbMigrations},
+	}
+}
+
+// PendingMigrations lists the migrations Migrate would apply without changing the DBs
+func (t *LogDb) PendingMigrations() ([]PendingMigration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	var res []PendingMigration
+	for _, db := range t.schemaDbs() {
+		migrations, err := pendingMigrations(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range migrations {
+			steps, err := migrationSteps(ctx, db.Db, migration)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, PendingMigration{
+				DbName:      db.Name,
+				Version:     migration.Version,
+				Description: migration.Description,
+				Steps:       steps,
+			})
+		}
+	}
+	return res, nil
+}
+
+// Migrate applies the pending migrations in order, each one in its own transaction.
+// Every DB with pending migrations is backed up once before the first of them.
+func (t *LogDb) Migrate() ([]PendingMigration, error) {
+	var res []PendingMigration
+	for _, db := range t.schemaDbs() {
+		applied, err := t.migrateDb(db)
+		res = append(res, applied...)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (t *LogDb) migrateDb(db schemaDb) ([]PendingMigration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MigrationTimeout)
+	defer cancel()
+
+	migrations, err := pendingMigrations(ctx, db)
+	if err != nil || len(migrations) == 0 {
+		return nil, err
+	}
+
+	// A new DB has nothing to lose
+	var tablesCount int
+	if err := db.Db.GetContext(ctx, &tablesCount, `SELECT COUNT(*) FROM sqlite_master WHERE type == "table"`); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to get tables of %s", db.Name), err)
+	}
+	if tablesCount > 0 {
+		backupPath, err := t.backupDb(ctx, db, migrations[0].Version)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Saved %s before migration to v%d: %s", db.Name, migrations[0].Version, backupPath)
+
+		deleted, err := t.pruneDbBackups(db.Name, MaxDbBackups)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range deleted {
+			log.Infof("Deleted old backup of %s: %s", db.Name, name)
+		}
+	}
+
+	var res []PendingMigration
+	for _, migration := range migrations {
+		info := PendingMigration{DbName: db.Name, Version: migration.Version, Description: migration.Description}
+		log.Infof("Applying migration %s", info)
+		if err := applyMigration(ctx, db, migration); err != nil {
+			return res, errors.Join(fmt.Errorf("unable to apply migration %s", info), err)
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// schemaVersion is the latest applied migration of the DB, 0 for a new DB
+func schemaVersion(ctx context.Context, db schemaDb) (int, error) {
+	var tablesCount int
+	err := db.Db.GetContext(ctx, &tablesCount, `SELECT COUNT(*) FROM sqlite_master WHERE type == "table" AND name == "SchemaMigrations"`)
+	if err != nil {
+		return 0, errors.Join(fmt.Errorf("unable to check SchemaMigrations of %s", db.Name), err)
+	}
+	if tablesCount == 0 {
+		return 0, nil
+	}
+
+	var version int
+	if err := db.Db.GetContext(ctx, &version, `SELECT COALESCE(MAX(Version), 0) FROM SchemaMigrations`); err != nil {
+		return 0, errors.Join(fmt.Errorf("unable to get schema version of %s", db.Name), err)
+	}
+	return version, nil
+}
+
+func pendingMigrations(ctx context.Context, db schemaDb) ([]schemaMigration, error) {
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	latestVersion := db.Migrations[len(db.Migrations)-1].Version
+	if version > latestVersion {
+		return nil, fmt.Errorf("%s schema version %d is newer than the supported %d, the monitor should be updated", db.Name, version, latestVersion)
+	}
+
+	var res []schemaMigration
+	for _, migration := range db.Migrations {
+		if migration.Version > version {
+			res = append(res, migration)
+		}
+	}
+	return res, nil
+}
+
+// migrationSteps describes the statements of the migration for the dry run
+func migrationSteps(ctx context.Context, db sqlx.QueryerContext, migration schemaMigration) ([]string, error) {
+	var res []string
+	for _, column := range migration.AddColumns {
+		exists, err := hasColumn(ctx, db, column)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			res = append(res, addColumnQuery(column))
+		}
+	}
+	for _, query := range migration.Queries {
+		res = append(res, strings.Join(strings.Fields(query), " "))
+	}
+	if migration.ApplyDescription != "" {
+		res = append(res, migration.ApplyDescription)
+	}
+	return res, nil
+}
+
+func applyMigration(ctx context.Context, db schemaDb, migration schemaMigration) error {
+	tx, err := db.Db.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return errors.Join(errors.New("unable to start migration transaction"), err)
+	}
+
+	err = execMigration(ctx, tx, migration)
+	if err != nil {
+		WarnIfErr(tx.Rollback())
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Join(errors.New("unable to commit migration transaction"), err)
+	}
+	return nil
+}
+
+func execMigration(ctx context.Context, tx *sqlx.Tx, migration schemaMigration) error {
+	_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS SchemaMigrations (
+		Version INTEGER NOT NULL PRIMARY KEY,
+		Description TEXT NOT NULL,
+		AppliedTs INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return errors.Join(errors.New("unable to create SchemaMigrations"), err)
+	}
+
+	for _, column := range migration.AddColumns {
+		exists, err := hasColumn(ctx, tx, column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, addColumnQuery(column)); err != nil {
+			return errors.Join(fmt.Errorf("unable to add column %s to %s", column.Name, column.Table), err)
+		}
+	}
+
+	for _, query := range migration.Queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return errors.Join(fmt.Errorf("unable to execute migration query %s", query), err)
+		}
+	}
+
+	if migration.Apply != nil {
+		if err := migration.Apply(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO SchemaMigrations (Version, Description, AppliedTs) VALUES (?, ?, ?)`,
+		migration.Version,
+		migration.Description,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return errors.Join(errors.New("unable to save schema version"), err)
+	}
+	return nil
+}
+
+func hasColumn(ctx context.Context, db sqlx.QueryerContext, column tableColumn) (bool, error) {
+	var count int
+	err := sqlx.GetContext(ctx, db, &count, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name == ?`, column.Table, column.Name)
+	if err != nil {
+		return false, errors.Join(fmt.Errorf("unable to get columns of %s", column.Table), err)
+	}
+	return count > 0, nil
+}
+
+func addColumnQuery(column tableColumn) string {
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, column.Table, column.Name, column.Definition)
+}
+
+// backupDb copies the DB to dbDir/backup with VACUUM INTO, so the copy is consistent despite WAL
+func (t *LogDb) backupDb(ctx context.Context, db schemaDb, version int) (string, error) {
+	backupDir := path.Join(t.dbDir, BackupDirName)
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return "", errors.Join(errors.New("unable to create backup dir"), err)
+	}
+
+	backupPath := path.Join(
+		backupDir,
+		fmt.Sprintf("%s.before-v%d.%s", db.Name, version, time.Now().UTC().Format(backupTimeFormat)),
+	)
+	if _, err := db.Db.ExecContext(ctx, `VACUUM INTO ?`, backupPath); err != nil {
+		return "", errors.Join(fmt.Errorf("unable to backup %s to %s", db.Name, backupPath), err)
+	}
+	return backupPath, nil
+}
+
+// pruneDbBackups deletes the backups of the DB except the latest maxBackups ones and returns the deleted names
+func (t *LogDb) pruneDbBackups(dbName string, maxBackups int) ([]string, error) {
+	backupDir := path.Join(t.dbDir, BackupDirName)
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, errors.Join(errors.New("unable to read backup dir"), err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), dbName+".before-v") {
+			names = append(names, entry.Name())
+		}
+	}
+	backupTime := func(name string) string {
+		return name[strings.LastIndex(name, ".")+1:]
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(strings.Compare(backupTime(b), backupTime(a)), strings.Compare(b, a))
+	})
+
+	var deleted []string
+	for _, name := range names[min(maxBackups, len(names)):] {
+		if err := os.Remove(path.Join(backupDir, name)); err != nil {
+			return deleted, errors.Join(fmt.Errorf("unable to delete backup %s", name), err)
+		}
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
+
+// reclassifyTlsHandshakeErrors moves the TLS handshake errors stored before they had their own type
+// to LogLineTypeTlsHandshakeError with the fields of the tlsHandshakeError rule of the built-in rules
+func reclassifyTlsHandshakeErrors(ctx context.Context, tx *sqlx.Tx) error {
+	var items []struct {
+		Id      int64  `db:"Id"`
+		LogLine string `db:"LogLine"`
+	}
+	err := tx.SelectContext(
+		ctx,
+		&items,
+		`SELECT Id, LogLine FROM LogRecords WHERE LogLineType == "LogLineTypeHttpSrvError" AND LogLine GLOB "*]: HTTPSRV *TLS handshake error from *"`,
+	)
+	if err != nil {
+		return errors.Join(errors.New("unable to select HTTPSRV records"), err)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	// The records are of the dumbproxy units already, whatever their names are
+	parser, err := NewLogParser(LogParserParams{Units: []string{"^.+$"}, Location: time.UTC})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Reclassifying %d TLS handshake errors", len(items))
+	for _, item := range items {
+		data, err := parser.ParseLogLine(item.LogLine)
+		if err != nil || data.LogLineType != LogLineTypeTlsHandshakeError {
+			continue
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE LogRecords SET LogLineType = ?, SrcIp = ?, SrcPort = ?, ErrorReason = ?, ErrorClass = ?, ErrorMessage = ? WHERE Id == ?`,
+			data.LogLineType.String(),
+			data.SrcIp,
+			data.SrcPort,
+			data.ErrorReason,
+			data.ErrorClass,
+			data.ErrorMessage,
+			item.Id,
+		)
+		if err != nil {
+			return errors.Join(errors.New("unable to reclassify TLS handshake error"), err)
+		}
+	}
+	return nil
+}
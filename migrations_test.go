@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func createLegacyDb(t *testing.T) string {
+	dbDir := t.TempDir()
+
+	logDb := Must1(sqlx.Open("sqlite3", path.Join(dbDir, "log.db")))
+	defer CloseOrWarn(logDb)
+	Must1(logDb.Exec(logDbMigrations[0].Queries[0]))
+	Must1(logDb.Exec(`INSERT INTO LogRecords VALUES (1, 1718668046, "LogLineTypeProxyRequest", "line", 1718668046, 0, 1, "host", 1, "", "", "192.0.2.7", "", 0, "user", "HTTP/1.1", "GET", "http://example.com/", 0, "")`))
+	Must1(logDb.Exec(`INSERT INTO LogRecords VALUES (2, 1718668046, "LogLineTypeHttpSrvError", ?, 1718668046, 0, 0, "host", 1, "main.go", "", "", "", 0, "", "", "", "", 0, "Starting proxy server...")`,
+		"Jun 18 00:07:26 host dumbproxy[1]: MAIN    : 2024/06/18 00:07:26 main.go:300: INFO     Starting proxy server..."))
+	Must1(logDb.Exec(`INSERT INTO LogRecords VALUES (3, 1718668046, "LogLineTypeHttpSrvError", ?, 1718668046, 1, 0, "host", 1, "server.go", "", "", "", 0, "", "", "", "", 0, "http: TLS handshake error")`,
+		"Jun 18 00:07:26 host dumbproxy[1]: HTTPSRV : 2024/06/18 00:07:26 server.go:3195: http: TLS handshake error from 192.0.2.7:5000: EOF"))
+
+	kvDb := Must1(sqlx.Open("sqlite3", path.Join(dbDir, "kv.db")))
+	defer CloseOrWarn(kvDb)
+	Must1(kvDb.Exec(kvDbMigrations[0].Queries[0]))
+	Must1(kvDb.Exec(`REPLACE INTO KvData (Name, Value) VALUES ("SchemaVersion", "2"), ("Source:default:LastLogTime", "1718668046")`))
+
+	return dbDir
+}
+
+func TestPendingMigrations(t *testing.T) {
+	db := Must1(OpenLogDb(createLegacyDb(t)))
+	defer db.Close()
+
+	pending := Must1(db.PendingMigrations())
+	assert.Len(t, pending, len(logDbMigrations)+len(kvDbMigrations)+len(cacheDbMigrations))
+	assert.Equal(t, "log.db v1: Create LogRecords", pending[0].String())
+	assert.Contains(t, pending[1].Steps, `ALTER TABLE LogRecords ADD COLUMN Source TEXT NOT NULL DEFAULT ""`)
+	assert.Equal(t, `DELETE FROM KvData WHERE Name == "SchemaVersion"`, pending[len(logDbMigrations)+len(kvDbMigrations)-1].Steps[0])
+	assert.Equal(t, "cache.db v1: Create CacheData", pending[len(pending)-len(cacheDbMigrations)].String())
+
+	// The dry run changes nothing
+	assert.Len(t, Must1(db.PendingMigrations()), len(pending))
+}
+
+func TestPendingMigrationsReadOnly(t *testing.T) {
+	_, err := OpenLogDbReadOnly(path.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+
+	listDir := func(dbDir string) []string {
+		var names []string
+		for _, entry := range Must1(os.ReadDir(dbDir)) {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	dbDir := createLegacyDb(t)
+	files := listDir(dbDir)
+	db := Must1(OpenLogDbReadOnly(dbDir))
+	assert.Len(t, Must1(db.PendingMigrations()), len(logDbMigrations)+len(kvDbMigrations)+len(cacheDbMigrations))
+	_, err = db.logDb.Exec(`DELETE FROM LogRecords`)
+	assert.Error(t, err)
+	db.Close()
+
+	// No WAL files, backups or cache.db appear, and the journal mode stays the same
+	assert.Equal(t, files, listDir(dbDir))
+	logDb := Must1(sqlx.Open("sqlite3", path.Join(dbDir, "log.db")))
+	defer CloseOrWarn(logDb)
+	var journalMode string
+	Must0(logDb.Get(&journalMode, `PRAGMA journal_mode`))
+	assert.Equal(t, "delete", journalMode)
+
+	// A migrated DB in the WAL mode that was closed cleanly gets no -wal and -shm files either
+	dbDir = t.TempDir()
+	Must1(NewLogDb(dbDir)).Close()
+	files = listDir(dbDir)
+	db = Must1(OpenLogDbReadOnly(dbDir))
+	assert.Empty(t, Must1(db.PendingMigrations()))
+	db.Close()
+	assert.Equal(t, files, listDir(dbDir))
+}
+
+func TestMigrateLegacyDb(t *testing.T) {
+	dbDir := createLegacyDb(t)
+	db := Must1(NewLogDb(dbDir))
+	defer db.Close()
+
+	assert.Empty(t, Must1(db.PendingMigrations()))
+
+	var item struct {
+		Username  string `db:"Username"`
+		LogTimeUs int64  `db:"LogTimeUs"`
+		Source    string `db:"Source"`
+	}
+	Must0(db.logDb.Get(&item, `SELECT Username, LogTimeUs, Source FROM LogRecords WHERE Id == 1`))
+	assert.Equal(t, "user", item.Username)
+	assert.Equal(t, int64(1718668046000000), item.LogTimeUs)
+	assert.Equal(t, "", item.Source)
+
+	var lineTypes []string
+	Must0(db.logDb.Select(&lineTypes, `SELECT LogLineType FROM LogRecords ORDER BY Id`))
+	assert.Equal(t, []string{"LogLineTypeProxyRequest", "LogLineTypeRuntimeLog", "LogLineTypeTlsHandshakeError"}, lineTypes)
+
+	var tlsItem struct {
+		SrcIp       string `db:"SrcIp"`
+		SrcPort     int    `db:"SrcPort"`
+		ErrorReason string `db:"ErrorReason"`
+	}
+	Must0(db.logDb.Get(&tlsItem, `SELECT SrcIp, SrcPort, ErrorReason FROM LogRecords WHERE Id == 3`))
+	assert.Equal(t, "192.0.2.7", tlsItem.SrcIp)
+	assert.Equal(t, 5000, tlsItem.SrcPort)
+	assert.Equal(t, "EOF", tlsItem.ErrorReason)
+
+	assert.Equal(t, 0, Must1(db.GetKvIntRecord("SchemaVersion")))
+	assert.Equal(t, "1718668046", Must1(db.GetKvStrRecord("Source:default:LastLogTime")))
+
+	// One backup per DB before its first pending migration, cache.db is new, so there is nothing to back up
+	var backups []string
+	for _, entry := range Must1(os.ReadDir(path.Join(dbDir, BackupDirName))) {
+		backups = append(backups, strings.Join(strings.Split(entry.Name(), ".")[:3], "."))
+	}
+	assert.Equal(t, []string{"kv.db.before-v1", "log.db.before-v1"}, backups)
+}
+
+func TestMigrateCacheDbV1(t *testing.T) {
+	dbDir := t.TempDir()
+	cacheDb := Must1(sqlx.Open("sqlite3", path.Join(dbDir, "cache.db")))
+	Must0(applyMigration(context.Background(), schemaDb{Name: "cache.db", Db: cacheDb}, cacheDbMigrations[0]))
+	Must1(cacheDb.Exec(`INSERT INTO CacheData (Key, Value, ExpiresTs) VALUES ("example.com", "93.184.216.34", ?)`, time.Now().Add(time.Hour).Unix()))
+	CloseOrWarn(cacheDb)
+
+	db := Must1(NewLogDb(dbDir))
+	defer db.Close()
+	assert.Empty(t, Must1(db.PendingMigrations()))
+
+	// The items without a namespace are dropped, the new ones are stored with it
+	namespace := CacheNamespace{Name: "Test", Ttl: time.Hour}
+	value := Must1(db.GetCached(namespace, "example.com", func() (string, bool, error) { return "", false, nil }))
+	assert.Equal(t, "", value)
+	var items []struct {
+		Key       string `db:"Key"`
+		Namespace string `db:"Namespace"`
+		Negative  bool   `db:"Negative"`
+	}
+	Must0(db.cacheDb.Select(&items, `SELECT Key, Namespace, Negative FROM CacheData`))
+	assert.Equal(t, []struct {
+		Key       string `db:"Key"`
+		Namespace string `db:"Namespace"`
+		Negative  bool   `db:"Negative"`
+	}{{"Test:example.com", "Test", true}}, items)
+
+	backups := Must1(os.ReadDir(path.Join(dbDir, BackupDirName)))
+	assert.Len(t, backups, 1)
+	assert.True(t, strings.HasPrefix(backups[0].Name(), "cache.db.before-v2."))
+}
+
+func TestPruneDbBackups(t *testing.T) {
+	dbDir := t.TempDir()
+	db := Must1(NewLogDb(dbDir))
+	defer db.Close()
+
+	backupDir := path.Join(dbDir, BackupDirName)
+	Must0(os.MkdirAll(backupDir, 0755))
+	for _, name := range []string{
+		"log.db.before-v9.20240601T000000Z",
+		"log.db.before-v10.20240602T000000Z",
+		"log.db.before-v11.20240603T000000Z",
+		"log.db.before-v2.20240501T000000Z",
+		"kv.db.before-v1.20240401T000000Z",
+	} {
+		Must0(os.WriteFile(path.Join(backupDir, name), nil, 0644))
+	}
+
+	assert.Equal(t, []string{"log.db.before-v9.20240601T000000Z", "log.db.before-v2.20240501T000000Z"}, Must1(db.pruneDbBackups("log.db", 2)))
+	var names []string
+	for _, entry := range Must1(os.ReadDir(backupDir)) {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"kv.db.before-v1.20240401T000000Z", "log.db.before-v10.20240602T000000Z", "log.db.before-v11.20240603T000000Z"}, names)
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	dbDir := t.TempDir()
+	db := Must1(NewLogDb(dbDir))
+	Must1(db.logDb.Exec(`INSERT INTO SchemaMigrations (Version, Description, AppliedTs) VALUES (1000, "future", 0)`))
+	db.Close()
+
+	_, err := NewLogDb(dbDir)
+	assert.ErrorContains(t, err, "log.db schema version 1000 is newer than the supported")
+	assert.NoDirExists(t, path.Join(dbDir, BackupDirName))
+}
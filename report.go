@@ -4,21 +4,53 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"time"
 )
 
+type LogReporterParams struct {
+	// Sources limits the report to these log sources, empty means all
+	Sources []string
+	// ReaderStates returns states of the log readers for the report, optional
+	ReaderStates func() []LogReaderState
+	// WriterStats returns stats of the DB writer for the report, optional
+	WriterStats func() LogWriterStats
+	// Location is the timezone of the report times, UTC by default
+	Location *time.Location
+	// TrendDays is the number of days of the long-term stats from the rollups, 0 hides them
+	TrendDays int
+	// DnsCacheTtl is the lifetime of the resolved domains of the src IPs
+	DnsCacheTtl time.Duration
+	// DnsNegativeCacheTtl is the lifetime of the src IPs without domains
+	DnsNegativeCacheTtl time.Duration
+}
+
+// MaxTrendTopItems is the max number of rows in the top lists of the long-term stats
+const MaxTrendTopItems = 20
+
 type LogReporter struct {
+	LogReporterParams
 	db       *LogDb
 	resolver *DnsResolver
 	tmpl     *template.Template
 }
 
-func NewLogReporter(db *LogDb) (*LogReporter, error) {
-	resolver, err := NewDnsResolver(db)
+func NewLogReporter(db *LogDb, params LogReporterParams) (*LogReporter, error) {
+	if params.Location == nil {
+		params.Location = time.UTC
+	}
+	if params.DnsCacheTtl == 0 {
+		params.DnsCacheTtl = 24 * time.Hour
+	}
+	if params.DnsNegativeCacheTtl == 0 {
+		params.DnsNegativeCacheTtl = time.Hour
+	}
+
+	resolver, err := NewDnsResolver(db, params.DnsCacheTtl, params.DnsNegativeCacheTtl)
 	if err != nil {
 		return nil, err
 	}
 
-	res := &LogReporter{db: db, resolver: resolver}
+	res := &LogReporter{LogReporterParams: params, db: db, resolver: resolver}
 	err = res.loadTemplates()
 	if err != nil {
 		return nil, fmt.Errorf("error when loading templates: %s", err)
@@ -32,7 +64,12 @@ func (t *LogReporter) GenerateReport() (string, error) {
 		return "", err
 	}
 
-	srcIpData, err := t.db.GetSrcIpReportData(lastId)
+	sourcesData, err := t.db.GetSourcesReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	srcIpData, err := t.db.GetSrcIpReportData(lastId, t.Sources)
 	if err != nil {
 		return "", err
 	}
@@ -41,27 +78,124 @@ func (t *LogReporter) GenerateReport() (string, error) {
 		WarnIfErr(err)
 	}
 
-	userData, err := t.db.GetUsersReportData(lastId)
+	userData, err := t.db.GetUsersReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	sitesData, err := t.db.GetSitesReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	userStatusesData, err := t.db.GetUserStatusesReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	upstreamErrorsData, err := t.db.GetUpstreamErrorsReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	tlsNoiseData, err := t.db.GetTlsNoiseReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(tlsNoiseData); i++ {
+		tlsNoiseData[i].SrcHost, err = t.resolver.ResolveDomain(tlsNoiseData[i].SrcIp)
+		WarnIfErr(err)
+	}
+
+	authFailuresData, err := t.db.GetAuthFailuresReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(authFailuresData); i++ {
+		authFailuresData[i].SrcHost, err = t.resolver.ResolveDomain(authFailuresData[i].SrcIp)
+		WarnIfErr(err)
+	}
+
+	unknownLinesData, err := t.db.GetUnknownLinesReportData(lastId, t.Sources)
 	if err != nil {
 		return "", err
 	}
 
+	parserCoverage, err := t.db.GetParserCoverageReportData(lastId, t.Sources)
+	if err != nil {
+		return "", err
+	}
+
+	var trendData *TrendReportData
+	if t.TrendDays > 0 {
+		if trendData, err = t.getTrendData(); err != nil {
+			return "", err
+		}
+	}
+
+	var readerStates []LogReaderState
+	if t.ReaderStates != nil {
+		readerStates = t.ReaderStates()
+	}
+
+	var writerStats *LogWriterStats
+	if t.WriterStats != nil {
+		stats := t.WriterStats()
+		writerStats = &stats
+	}
+
+	cacheStats := t.db.CacheStats()
+
 	tplWriter := bytes.NewBufferString("")
 	err = t.tmpl.ExecuteTemplate(tplWriter, "report.html.tmpl", map[string]any{
-		"SrcIpData": srcIpData,
-		"UserData":  userData,
+		"ReaderStates":       readerStates,
+		"WriterStats":        writerStats,
+		"CacheStats":         cacheStats,
+		"SourcesData":        sourcesData,
+		"SrcIpData":          srcIpData,
+		"UserData":           userData,
+		"SitesData":          sitesData,
+		"UserStatusesData":   userStatusesData,
+		"UpstreamErrorsData": upstreamErrorsData,
+		"TlsNoiseData":       tlsNoiseData,
+		"AuthFailuresData":   authFailuresData,
+		"UnknownLinesData":   unknownLinesData,
+		"ParserCoverage":     parserCoverage,
+		"TrendData":          trendData,
 	})
 	if err != nil {
 		return "", err
 	}
 
 	var newLastId uint64
+	for _, data := range sourcesData {
+		newLastId = max(newLastId, data.LastId)
+	}
 	for _, data := range srcIpData {
 		newLastId = max(newLastId, data.LastId)
 	}
 	for _, data := range userData {
 		newLastId = max(newLastId, data.LastId)
 	}
+	for _, data := range sitesData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	for _, data := range userStatusesData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	for _, data := range upstreamErrorsData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	for _, data := range tlsNoiseData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	for _, data := range authFailuresData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	for _, data := range unknownLinesData {
+		newLastId = max(newLastId, data.LastId)
+	}
+	newLastId = max(newLastId, parserCoverage.LastId)
 
 	if err = t.db.SetLastId(newLastId); err != nil {
 		return "", err
@@ -70,11 +204,63 @@ func (t *LogReporter) GenerateReport() (string, error) {
 	return tplWriter.String(), nil
 }
 
+// TrendReportData is the long-term stats of the last days, it doesn't depend on the last reported record
+type TrendReportData struct {
+	Days int
+	// Location is the timezone of the days
+	Location string
+	Daily    []DailyTrendReportData
+	Tops     []TrendTopReportData
+}
+
+type TrendTopReportData struct {
+	Title string
+	Items []RollupTopReportData
+}
+
+// trendTops are the top lists of the long-term stats with the rollup dimensions they are grouped by
+var trendTops = []struct {
+	Title     string
+	Dimension string
+}{
+	{"Top users", "Username"},
+	{"Top sites", "SiteDomain"},
+	{"Top src IPs", "SrcIp"},
+	{"Error causes", "ErrorClass"},
+}
+
+func (t *LogReporter) getTrendData() (*TrendReportData, error) {
+	if err := t.db.RollupLogRecords(); err != nil {
+		return nil, err
+	}
+
+	daily, err := t.db.GetDailyTrendReportData(t.TrendDays, t.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TrendReportData{Days: t.TrendDays, Location: t.Location.String(), Daily: daily}
+	for _, top := range trendTops {
+		items, err := t.db.GetRollupTopReportData(top.Dimension, t.TrendDays, MaxTrendTopItems, t.Sources)
+		if err != nil {
+			return nil, err
+		}
+		res.Tops = append(res.Tops, TrendTopReportData{Title: top.Title, Items: items})
+	}
+	return res, nil
+}
+
 func (t *LogReporter) loadTemplates() error {
 	tmpl, err := template.New("").Funcs(template.FuncMap{
 		"attr": func(s string) template.HTMLAttr {
 			return template.HTMLAttr(s)
 		},
+		"reportTime": func(tm time.Time) string {
+			return tm.In(t.Location).Format(time.RFC3339)
+		},
+		"roundDuration": func(d time.Duration) time.Duration {
+			return d.Round(time.Millisecond)
+		},
 	}).ParseGlob("templates/*.tmpl")
 	if err != nil {
 		return err
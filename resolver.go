@@ -9,11 +9,16 @@ import (
 )
 
 type DnsResolver struct {
-	db *LogDb
+	db        *LogDb
+	namespace CacheNamespace
 }
 
-func NewDnsResolver(db *LogDb) (*DnsResolver, error) {
-	return &DnsResolver{db: db}, nil
+// NewDnsResolver caches resolved domains for ttl and unresolved addresses for negativeTtl
+func NewDnsResolver(db *LogDb, ttl time.Duration, negativeTtl time.Duration) (*DnsResolver, error) {
+	return &DnsResolver{
+		db:        db,
+		namespace: CacheNamespace{Name: "DnsResolver:ResolveDomain", Ttl: ttl, NegativeTtl: negativeTtl},
+	}, nil
 }
 
 func (t *DnsResolver) ResolveDomain(ipAddr string) (string, error) {
@@ -21,19 +26,19 @@ func (t *DnsResolver) ResolveDomain(ipAddr string) (string, error) {
 		return "<empty>", nil
 	}
 
-	return t.db.GetCached("DnsResolver:ResolveDomain:"+ipAddr, 24*time.Hour, func() (string, error) {
+	return t.db.GetCached(t.namespace, ipAddr, func() (string, bool, error) {
 		finalName := fmt.Sprintf("<Unresolved: %s>", ipAddr)
 
 		vals, err := net.LookupAddr(ipAddr)
 		if err != nil {
 			if strings.Contains(err.Error(), "no such host") {
-				return finalName, nil
+				return finalName, false, nil
 			}
-			return finalName, errors.Join(errors.New("unable to resolve domain"), err)
+			return finalName, false, errors.Join(errors.New("unable to resolve domain"), err)
 		}
 
 		if len(vals) == 0 {
-			return finalName, nil
+			return finalName, false, nil
 		}
 
 		finalName = vals[0]
@@ -42,6 +47,6 @@ func (t *DnsResolver) ResolveDomain(ipAddr string) (string, error) {
 				finalName = val
 			}
 		}
-		return finalName, nil
+		return finalName, true, nil
 	})
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type restoreArgs struct {
+	dbDir      string
+	archiveDir string
+	fromDate   string
+	toDate     string
+	batchSize  int
+	force      bool
+}
+
+type RestoreStats struct {
+	Files      int
+	Records    int
+	Failed     int
+	Duplicates int
+	Stored     int
+}
+
+// runRestore loads archived log records of a range of days into a scratch DB for investigation
+func runRestore(argv []string) {
+	args := getRestoreArgs(argv)
+
+	filePaths := Must1(ListArchiveFiles(args.archiveDir, args.fromDate, args.toDate))
+	if len(filePaths) == 0 {
+		log.Fatalf("No archive files in %s from %q to %q", args.archiveDir, args.fromDate, args.toDate)
+	}
+
+	db := Must1(NewLogDb(args.dbDir))
+	defer db.Close()
+
+	var stats RestoreStats
+	startTime := time.Now()
+	batch := make([]*LogLineData, 0, args.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if duplicates, err := db.InsertLogRecords(batch); err != nil {
+			log.Errorf("Unable to insert %d records: %s", len(batch), err)
+			stats.Failed += len(batch)
+		} else {
+			stats.Duplicates += duplicates
+			stats.Stored += len(batch) - duplicates
+		}
+		batch = batch[:0]
+	}
+
+	for _, filePath := range filePaths {
+		log.Infof("Restoring %s", filePath)
+		stats.Files++
+		err := ReadArchiveFile(filePath, func(item *ArchivedLogRecord) error {
+			stats.Records++
+			batch = append(batch, item.ToLogLineData())
+			if len(batch) >= args.batchSize {
+				flush()
+			}
+			return nil
+		})
+		flush()
+		if err != nil {
+			log.Errorf("Restore of %s failed: %s", filePath, err)
+		}
+	}
+
+	fmt.Printf(
+		"Restore finished in %s: files %d, records %d, failed %d, duplicates %d, stored %d\n",
+		time.Since(startTime).Round(time.Millisecond),
+		stats.Files,
+		stats.Records,
+		stats.Failed,
+		stats.Duplicates,
+		stats.Stored,
+	)
+}
+
+func getRestoreArgs(argv []string) restoreArgs {
+	var args restoreArgs
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	flagSet.StringVar(&args.dbDir, "dbDir", "", "Scratch DB directory to restore the records to")
+	flagSet.StringVar(&args.archiveDir, "archiveDir", "", "Archive directory, usually archive in the DB directory of the monitor")
+	flagSet.StringVar(&args.fromDate, "from", "", "First UTC day like 2024-06-18 to restore, the oldest archived day by default")
+	flagSet.StringVar(&args.toDate, "to", "", "Last UTC day like 2024-06-18 to restore, the newest archived day by default")
+	flagSet.IntVar(&args.batchSize, "batchSize", 1000, "Records in one insert transaction")
+	flagSet.BoolVar(&args.force, "force", false, "Restore to -dbDir that already has log.db")
+	Must0(flagSet.Parse(argv))
+
+	if args.dbDir == "" || args.archiveDir == "" {
+		log.Fatalln("-dbDir and -archiveDir are required")
+	}
+	if err := checkRestoreDbDir(args.dbDir, args.archiveDir, args.force); err != nil {
+		log.Fatalln(err)
+	}
+	for _, date := range []string{args.fromDate, args.toDate} {
+		if _, err := time.Parse(time.DateOnly, date); date != "" && err != nil {
+			log.Fatalf("Invalid date %q: %s", date, err)
+		}
+	}
+	if args.batchSize <= 0 {
+		log.Fatalln("-batchSize should be positive")
+	}
+
+	return args
+}
+
+// checkRestoreDbDir refuses the DB of the archive by any path to it, and an existing DB without force
+func checkRestoreDbDir(dbDir string, archiveDir string, force bool) error {
+	realDbDir, err := resolvePath(dbDir)
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to resolve -dbDir %s", dbDir), err)
+	}
+	realArchiveDir, err := resolvePath(archiveDir)
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to resolve -archiveDir %s", archiveDir), err)
+	}
+	if realDbDir == filepath.Dir(realArchiveDir) {
+		return errors.New("-dbDir should be a scratch DB, not the DB of the archive")
+	}
+
+	if _, err := os.Stat(filepath.Join(realDbDir, "log.db")); err == nil {
+		if !force {
+			return fmt.Errorf("-dbDir %s already has log.db, use -force to restore to it anyway", dbDir)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Join(fmt.Errorf("unable to check log.db in -dbDir %s", dbDir), err)
+	}
+	return nil
+}
+
+// resolvePath is the absolute path without symlinks, a missing part is resolved by its nearest existing parent
+func resolvePath(filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if os.IsNotExist(err) && filepath.Dir(absPath) != absPath {
+		realParent, err := resolvePath(filepath.Dir(absPath))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(realParent, filepath.Base(absPath)), nil
+	}
+	return realPath, err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRestoreDbDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	monitorDir := path.Join(tmpDir, "monitor")
+	archiveDir := path.Join(monitorDir, "archive")
+	Must0(os.MkdirAll(archiveDir, 0755))
+	Must0(os.WriteFile(path.Join(monitorDir, "log.db"), nil, 0644))
+	Must0(os.Symlink(monitorDir, path.Join(tmpDir, "link")))
+
+	// The DB of the archive is refused by any path to it, even with force
+	for _, dbDir := range []string{monitorDir, monitorDir + "/", path.Join(archiveDir, ".."), path.Join(tmpDir, "link")} {
+		assert.Error(t, checkRestoreDbDir(dbDir, archiveDir, true), dbDir)
+	}
+	assert.Error(t, checkRestoreDbDir(monitorDir, path.Join(tmpDir, "link", "archive"), true))
+
+	wd := Must1(os.Getwd())
+	defer func() { Must0(os.Chdir(wd)) }()
+	Must0(os.Chdir(tmpDir))
+	assert.Error(t, checkRestoreDbDir("monitor", archiveDir, true))
+
+	// A new dir, also under a symlink, is fine
+	assert.NoError(t, checkRestoreDbDir(path.Join(tmpDir, "scratch", "new"), archiveDir, false))
+	assert.NoError(t, checkRestoreDbDir(filepath.Join("link", "scratch"), archiveDir, false))
+
+	// An existing DB needs force
+	scratchDir := path.Join(tmpDir, "scratch")
+	Must0(os.MkdirAll(scratchDir, 0755))
+	Must0(os.WriteFile(path.Join(scratchDir, "log.db"), nil, 0644))
+	assert.Error(t, checkRestoreDbDir(scratchDir, archiveDir, false))
+	assert.NoError(t, checkRestoreDbDir(scratchDir, archiveDir, true))
+}
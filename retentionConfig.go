@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// RetentionRule keeps the log records it matches for MaxAge, empty conditions match any record
+type RetentionRule struct {
+	// LogLineType is a type name like LogLineTypeOtherUnit
+	LogLineType string
+	Source      string
+	IsError     *bool
+	// MaxAge is a duration like 720h
+	MaxAge string
+
+	maxAge time.Duration
+}
+
+type RetentionParams struct {
+	// MaxAge is the retention of the records no rule matches
+	MaxAge time.Duration
+	// Rules are checked in order, the first matching rule sets the retention of a record
+	Rules []RetentionRule
+	// MaxDbSize is the max size of the used pages of log.db with its WAL in bytes, the oldest records are deleted above it, 0 disables the cap
+	MaxDbSize int64
+	// ArchiveDir is the directory to archive the deleted records to, empty disables archiving
+	ArchiveDir string
+}
+
+func LoadRetentionRules(configPath string) ([]RetentionRule, error) {
+	confFp, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open retention rules file: %s", err)
+	}
+	defer CloseOrWarn(confFp)
+
+	confContent, err := io.ReadAll(confFp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read retention rules file: %s", err)
+	}
+
+	var rules []RetentionRule
+	if err := json.Unmarshal(confContent, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse retention rules: %s", err)
+	}
+
+	if err := ValidateRetentionRules(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ValidateRetentionRules checks the rules and parses their max ages
+func ValidateRetentionRules(rules []RetentionRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.LogLineType != "" {
+			if _, ok := LogLineTypeFromString(rule.LogLineType); !ok {
+				return fmt.Errorf("invalid line type of retention rule %d: %s", i, rule.LogLineType)
+			}
+		}
+
+		maxAge, err := time.ParseDuration(rule.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid max age of retention rule %d: %s", i, err)
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("max age of retention rule %d should be positive", i)
+		}
+		rule.maxAge = maxAge
+	}
+	return nil
+}
+
+// condition returns the SQL condition matching the records of the rule
+func (t RetentionRule) condition() (string, []interface{}) {
+	conds := []string{"1"}
+	var args []interface{}
+	if t.LogLineType != "" {
+		conds = append(conds, "LogLineType == ?")
+		args = append(args, t.LogLineType)
+	}
+	if t.Source != "" {
+		conds = append(conds, "Source == ?")
+		args = append(args, t.Source)
+	}
+	if t.IsError != nil {
+		conds = append(conds, "IsError == ?")
+		args = append(args, *t.IsError)
+	}
+	return "(" + strings.Join(conds, " AND ") + ")", args
+}
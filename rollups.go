@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// RollupBatchSize is the max number of log records aggregated in one rollup transaction
+const RollupBatchSize = 50000
+
+// hourLength is the length of the hourly rollup buckets in seconds, they are aligned to UTC hours
+const hourLength = int64(time.Hour / time.Second)
+
+// rollupTableQuery creates a table of record counts by bucket and the dimensions the long-term stats are grouped by
+func rollupTableQuery(table string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		BucketTs INTEGER NOT NULL,
+		Source TEXT NOT NULL,
+		LogLineType TEXT NOT NULL,
+		Username TEXT NOT NULL,
+		SrcIp TEXT NOT NULL,
+		SiteDomain TEXT NOT NULL,
+		ErrorClass TEXT NOT NULL,
+		Records INTEGER NOT NULL,
+		Errors INTEGER NOT NULL,
+		FirstLogTime INTEGER NOT NULL,
+		LastLogTime INTEGER NOT NULL,
+		PRIMARY KEY (BucketTs, Source, LogLineType, Username, SrcIp, SiteDomain, ErrorClass)
+	)`, table)
+}
+
+type RollupTopReportData struct {
+	BasicGroupReportData
+	Name   string `db:"Name"`
+	Errors int    `db:"Errors"`
+	Days   int    `db:"Days"`
+}
+
+type DailyTrendReportData struct {
+	BucketTs int64 `db:"BucketTs"`
+	Reqs     int   `db:"Reqs"`
+	Errors   int   `db:"Errors"`
+	Users    int   `db:"Users"`
+	SrcIps   int   `db:"SrcIps"`
+	Sites    int   `db:"Sites"`
+	Day      time.Time
+}
+
+// rollupTopDimensions are the columns the top lists of the rollups can be grouped by
+var rollupTopDimensions = []string{"Username", "SrcIp", "SiteDomain", "ErrorClass"}
+
+// SetRollupLocation sets the timezone of the days of the daily rollups and the trend report, UTC by default.
+// The days that are already rolled up keep their previous timezone.
+func (t *LogDb) SetRollupLocation(location *time.Location) {
+	t.rollupLocation = location
+}
+
+// RollupLogRecords adds the log records stored after the previous call to the hourly and daily rollups
+func (t *LogDb) RollupLogRecords() error {
+	log.Trace("Executing RollupLogRecords()")
+	ctx, cancel := context.WithTimeout(context.Background(), MigrationTimeout)
+	defer cancel()
+
+	var lastId int64
+	err := t.logDb.GetContext(ctx, &lastId, `SELECT Value FROM RollupState WHERE Name == "LastId"`)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return errors.Join(errors.New("unable to get last rolled up record"), err)
+	}
+
+	// Rows with Ids up to the max committed one are never inserted later, so they can be aggregated once
+	var maxId int64
+	if err := t.logDb.GetContext(ctx, &maxId, `SELECT COALESCE(MAX(Id), 0) FROM LogRecords`); err != nil {
+		return errors.Join(errors.New("unable to get last log record"), err)
+	}
+
+	for lastId < maxId {
+		toId := min(lastId+RollupBatchSize, maxId)
+		if err := t.rollupBatch(ctx, lastId, toId); err != nil {
+			return err
+		}
+		lastId = toId
+	}
+	return nil
+}
+
+func (t *LogDb) rollupBatch(ctx context.Context, fromId int64, toId int64) error {
+	tx, err := t.logDb.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return errors.Join(errors.New("unable to start rollup transaction"), err)
+	}
+
+	hourlyQuery := rollupQuery("HourlyRollups", "LogTime - LogTime % ?", "")
+	if _, err := tx.ExecContext(ctx, hourlyQuery, hourLength, fromId, toId); err != nil {
+		WarnIfErr(tx.Rollback())
+		return errors.Join(errors.New("unable to fill HourlyRollups"), err)
+	}
+
+	// Days in the rollup location have different lengths because of DST, so their bounds are joined from a table
+	if err := t.fillRollupDays(ctx, tx, fromId, toId); err != nil {
+		WarnIfErr(tx.Rollback())
+		return err
+	}
+	dailyQuery := rollupQuery("DailyRollups", "RollupDays.StartTs", "JOIN temp.RollupDays ON LogTime >= RollupDays.StartTs AND LogTime < RollupDays.EndTs")
+	if _, err := tx.ExecContext(ctx, dailyQuery, fromId, toId); err != nil {
+		WarnIfErr(tx.Rollback())
+		return errors.Join(errors.New("unable to fill DailyRollups"), err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `REPLACE INTO RollupState (Name, Value) VALUES ("LastId", ?)`, toId); err != nil {
+		WarnIfErr(tx.Rollback())
+		return errors.Join(errors.New("unable to save last rolled up record"), err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Join(errors.New("unable to commit rollup transaction"), err)
+	}
+	return nil
+}
+
+// rollupQuery adds the records of an Id range to the rollup table by the bucket of their log time
+func rollupQuery(table string, bucketExpr string, join string) string {
+	return fmt.Sprintf(`
+		INSERT INTO %s (BucketTs, Source, LogLineType, Username, SrcIp, SiteDomain, ErrorClass, Records, Errors, FirstLogTime, LastLogTime)
+		SELECT
+			%s,
+			Source,
+			LogLineType,
+			Username,
+			SrcIp,
+			SiteDomain,
+			ErrorClass,
+			COUNT(*),
+			SUM(IsError),
+			MIN(LogTime),
+			MAX(LogTime)
+		FROM
+			LogRecords
+			%s
+		WHERE
+			Id > ? AND Id <= ?
+		GROUP BY
+			1, 2, 3, 4, 5, 6, 7
+		ON CONFLICT DO UPDATE SET
+			Records = Records + excluded.Records,
+			Errors = Errors + excluded.Errors,
+			FirstLogTime = MIN(FirstLogTime, excluded.FirstLogTime),
+			LastLogTime = MAX(LastLogTime, excluded.LastLogTime)
+	`, table, bucketExpr, join)
+}
+
+// fillRollupDays fills the temporary RollupDays table with the days in the rollup location
+// that the log times of the records of an Id range fall into
+func (t *LogDb) fillRollupDays(ctx context.Context, tx *sqlx.Tx, fromId int64, toId int64) error {
+	var bounds struct {
+		MinLogTime int64 `db:"MinLogTime"`
+		MaxLogTime int64 `db:"MaxLogTime"`
+	}
+	err := tx.GetContext(
+		ctx,
+		&bounds,
+		`SELECT COALESCE(MIN(LogTime), 0) AS MinLogTime, COALESCE(MAX(LogTime), 0) AS MaxLogTime FROM LogRecords WHERE Id > ? AND Id <= ?`,
+		fromId,
+		toId,
+	)
+	if err != nil {
+		return errors.Join(errors.New("unable to get log times of rollup batch"), err)
+	}
+
+	queries := []string{
+		`CREATE TEMP TABLE IF NOT EXISTS RollupDays (StartTs INTEGER NOT NULL PRIMARY KEY, EndTs INTEGER NOT NULL)`,
+		`DELETE FROM temp.RollupDays`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return errors.Join(errors.New("unable to prepare RollupDays"), err)
+		}
+	}
+
+	day := dayStart(time.Unix(bounds.MinLogTime, 0), t.rollupLocation)
+	for day.Unix() <= bounds.MaxLogTime {
+		nextDay := day.AddDate(0, 0, 1)
+		if _, err := tx.ExecContext(ctx, `INSERT INTO temp.RollupDays (StartTs, EndTs) VALUES (?, ?)`, day.Unix(), nextDay.Unix()); err != nil {
+			return errors.Join(errors.New("unable to fill RollupDays"), err)
+		}
+		day = nextDay
+	}
+	return nil
+}
+
+// RollupsVacuumClean deletes hourly and daily buckets older than their retention
+func (t *LogDb) RollupsVacuumClean(hourlyMaxAge time.Duration, dailyMaxAge time.Duration) (int64, error) {
+	log.Tracef("Executing RollupsVacuumClean(%s, %s)", hourlyMaxAge, dailyMaxAge)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	var total int64
+	now := time.Now()
+	for table, maxAge := range map[string]time.Duration{"HourlyRollups": hourlyMaxAge, "DailyRollups": dailyMaxAge} {
+		res, err := t.logDb.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE BucketTs < ?`, table), now.Add(-maxAge).Unix())
+		if err != nil {
+			return total, errors.Join(fmt.Errorf("unable to vacuum clean %s", table), err)
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+	}
+	return total, nil
+}
+
+// GetDailyTrendReportData returns daily totals of the last days from the daily rollups
+func (t *LogDb) GetDailyTrendReportData(days int, sources []string) ([]DailyTrendReportData, error) {
+	log.Tracef("Executing GetDailyTrendReportData(%d, %v)", days, sources)
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []DailyTrendReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT
+		    BucketTs,
+		    SUM(CASE WHEN LogLineType == "LogLineTypeProxyRequest" THEN Records ELSE 0 END) AS Reqs,
+		    SUM(Errors) AS Errors,
+		    COUNT(DISTINCT CASE WHEN LogLineType == "LogLineTypeProxyRequest" THEN Username END) AS Users,
+		    COUNT(DISTINCT CASE WHEN LogLineType == "LogLineTypeProxyRequest" THEN SrcIp END) AS SrcIps,
+		    COUNT(DISTINCT CASE WHEN LogLineType == "LogLineTypeProxyRequest" THEN SiteDomain END) AS Sites
+		FROM
+		    DailyRollups
+		WHERE
+			BucketTs >= ?
+			%s
+		GROUP BY
+		    BucketTs
+		ORDER BY
+		    BucketTs DESC
+		`, sourcesCond),
+		append([]interface{}{trendStartTs(days, time.Now(), t.rollupLocation)}, sourcesArgs...)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetDailyTrendReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		items[i].Day = time.Unix(items[i].BucketTs, 0).In(t.rollupLocation)
+	}
+	return items, nil
+}
+
+// GetRollupTopReportData returns the top values of the dimension during the last days from the daily rollups
+func (t *LogDb) GetRollupTopReportData(dimension string, days int, limit int, sources []string) ([]RollupTopReportData, error) {
+	log.Tracef("Executing GetRollupTopReportData(%s, %d, %d, %v)", dimension, days, limit, sources)
+	if !slices.Contains(rollupTopDimensions, dimension) {
+		return nil, fmt.Errorf("unknown rollup dimension: %s", dimension)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	sourcesCond, sourcesArgs := sourcesCondition(sources)
+	var items []RollupTopReportData
+	err := t.logDb.SelectContext(
+		ctx,
+		&items,
+		fmt.Sprintf(`
+		SELECT
+		    %[1]s AS Name,
+		    SUM(CASE WHEN LogLineType == "LogLineTypeProxyRequest" THEN Records ELSE 0 END) AS Reqs,
+		    SUM(Errors) AS Errors,
+		    COUNT(DISTINCT BucketTs) AS Days,
+		    MIN(FirstLogTime) AS FirstTs,
+		    MAX(LastLogTime) AS LastTs
+		FROM
+		    DailyRollups
+		WHERE
+			BucketTs >= ?
+			AND %[1]s != ""
+			%[2]s
+		GROUP BY
+		    %[1]s
+		ORDER BY
+		    Reqs DESC, Errors DESC
+		LIMIT ?
+		`, dimension, sourcesCond),
+		append(append([]interface{}{trendStartTs(days, time.Now(), t.rollupLocation)}, sourcesArgs...), limit)...,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("error when GetRollupTopReportData"), err)
+	}
+
+	for i := 0; i < len(items); i++ {
+		setTimes(&items[i].BasicGroupReportData)
+	}
+	return items, nil
+}
+
+// trendStartTs is the start of the first day in the location of the last days including today
+func trendStartTs(days int, now time.Time, location *time.Location) int64 {
+	return dayStart(now, location).AddDate(0, 0, -(days - 1)).Unix()
+}
+
+// dayStart is the midnight of the day of the time in the location
+func dayStart(ts time.Time, location *time.Location) time.Time {
+	ts = ts.In(location)
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, location)
+}
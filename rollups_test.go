@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupLogRecords(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+
+	newItem := func(sec int, user string) *LogLineData {
+		return parseProxyRecord(sec, fmt.Sprintf(`Request: 1.2.3.4:5000 => 2.56.204.64:443 "%s" HTTP/1.1 GET http://www.example.com/a`, user))
+	}
+	Must1(db.InsertLogRecords([]*LogLineData{newItem(1, "bob"), newItem(2, "bob"), newItem(3, "alice")}))
+	Must0(db.RollupLogRecords())
+	Must0(db.RollupLogRecords())
+
+	// Raw records are rolled up before they are deleted
+	Must1(db.InsertLogRecords([]*LogLineData{newItem(4, "bob")}))
+	Must1(db.logDb.Exec(`UPDATE LogRecords SET Ts = 0`))
+	assert.Equal(t, int64(4), Must1(db.LogRecordsVacuumClean(RetentionParams{MaxAge: 48 * time.Hour})))
+
+	var hourly []struct {
+		BucketTs int64  `db:"BucketTs"`
+		Username string `db:"Username"`
+		Records  int    `db:"Records"`
+	}
+	Must0(db.logDb.Select(&hourly, `SELECT BucketTs, Username, Records FROM HourlyRollups ORDER BY Username`))
+	bucketTs := time.Date(2024, time.June, 18, 0, 7, 0, 0, time.Local).Truncate(time.Hour).Unix()
+	assert.Equal(t, []struct {
+		BucketTs int64  `db:"BucketTs"`
+		Username string `db:"Username"`
+		Records  int    `db:"Records"`
+	}{
+		{bucketTs, "alice", 1},
+		{bucketTs, "bob", 3},
+	}, hourly)
+
+	days := int(time.Since(time.Date(2024, time.June, 17, 0, 0, 0, 0, time.UTC)).Hours()/24) + 1
+	users := Must1(db.GetRollupTopReportData("Username", days, 10, nil))
+	assert.Len(t, users, 2)
+	assert.Equal(t, "bob", users[0].Name)
+	assert.Equal(t, 3, users[0].Reqs)
+
+	daily := Must1(db.GetDailyTrendReportData(days, []string{""}))
+	assert.Len(t, daily, 1)
+	assert.Equal(t, 4, daily[0].Reqs)
+	assert.Equal(t, 2, daily[0].Users)
+	assert.Equal(t, 1, daily[0].Sites)
+
+	_, err := db.GetRollupTopReportData("LogLine", days, 10, nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, int64(0), Must1(db.RollupsVacuumClean(24*time.Hour*time.Duration(days+1), 24*time.Hour*time.Duration(days+1))))
+	assert.Equal(t, int64(4), Must1(db.RollupsVacuumClean(time.Hour, time.Hour)))
+}
+
+func TestRollupDaysInLocation(t *testing.T) {
+	db := Must1(NewLogDb(t.TempDir()))
+	defer db.Close()
+	amsterdam := Must1(time.LoadLocation("Europe/Amsterdam"))
+	db.SetRollupLocation(amsterdam)
+
+	// The summer time starts on March 31, so that day is 23 hours long
+	var items []*LogLineData
+	for i, logTime := range []time.Time{
+		time.Date(2024, time.March, 30, 23, 30, 0, 0, amsterdam),
+		time.Date(2024, time.March, 31, 0, 30, 0, 0, amsterdam),
+		time.Date(2024, time.March, 31, 23, 30, 0, 0, amsterdam),
+		time.Date(2024, time.April, 1, 0, 30, 0, 0, amsterdam),
+	} {
+		item := parseProxyRecord(i, `Request: 1.2.3.4:5000 => 2.56.204.64:443 "bob" HTTP/1.1 GET http://www.example.com/a`)
+		item.LogTime = logTime.UTC()
+		items = append(items, item)
+	}
+	Must1(db.InsertLogRecords(items))
+	Must0(db.RollupLogRecords())
+
+	var daily []struct {
+		BucketTs int64 `db:"BucketTs"`
+		Records  int   `db:"Records"`
+	}
+	Must0(db.logDb.Select(&daily, `SELECT BucketTs, Records FROM DailyRollups ORDER BY BucketTs`))
+	assert.Equal(t, []struct {
+		BucketTs int64 `db:"BucketTs"`
+		Records  int   `db:"Records"`
+	}{
+		{time.Date(2024, time.March, 30, 0, 0, 0, 0, amsterdam).Unix(), 1},
+		{time.Date(2024, time.March, 31, 0, 0, 0, 0, amsterdam).Unix(), 2},
+		{time.Date(2024, time.April, 1, 0, 0, 0, 0, amsterdam).Unix(), 1},
+	}, daily)
+
+	now := time.Date(2024, time.April, 1, 12, 0, 0, 0, amsterdam)
+	assert.Equal(t, time.Date(2024, time.March, 31, 0, 0, 0, 0, amsterdam).Unix(), trendStartTs(2, now, amsterdam))
+	assert.Equal(t, time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC).Unix(), trendStartTs(1, now, time.UTC))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oriser/regroup"
+)
+
+var syslog3164Re = regroup.MustCompile("^(?P<month>[A-Z][a-z]{2})\\s+(?P<day>\\d+)\\s+(?P<hour>\\d+):(?P<minute>\\d+):(?P<sec>\\d+)\\s+(?P<host>\\S+)\\s+(?P<unit>[^\\s\\[:]+)(?:\\[(?P<pid>\\d+)])?:\\s*(?P<logRecord>.*)$")
+
+// ParseSyslogMessage parses a network syslog message in RFC 5424 or RFC 3164 format.
+// RFC 3164 times have no offset and are taken in the location.
+func ParseSyslogMessage(msg string, location *time.Location) (*SystemDLogLineRecord, error) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	body, err := stripSyslogPriority(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(body, "1 ") {
+		return parseSyslog5424(body[2:], location)
+	}
+	return parseSyslog3164(body, location)
+}
+
+func stripSyslogPriority(msg string) (string, error) {
+	if !strings.HasPrefix(msg, "<") {
+		return "", errors.Join(errors.New("syslog message has no priority"), ErrorParse)
+	}
+
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return "", errors.Join(errors.New("invalid syslog priority"), ErrorParse)
+	}
+	if _, err := strconv.Atoi(msg[1:end]); err != nil {
+		return "", errors.Join(errors.New("invalid syslog priority"), ErrorParse, err)
+	}
+	return msg[end+1:], nil
+}
+
+func parseSyslog3164(body string, location *time.Location) (*SystemDLogLineRecord, error) {
+	var data SystemDLogLineRecord
+	if err := syslog3164Re.MatchToTarget(body, &data); err != nil {
+		return nil, errors.Join(errors.New("invalid RFC 3164 syslog message"), ErrorParse, err)
+	}
+	data.LogTime = shortLogTime(&data, time.Now(), location)
+	return &data, nil
+}
+
+// parseSyslog5424 parses the part of the message after the version:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseSyslog5424(body string, location *time.Location) (*SystemDLogLineRecord, error) {
+	fields := strings.SplitN(body, " ", 6)
+	if len(fields) < 6 {
+		return nil, errors.Join(errors.New("invalid RFC 5424 syslog message"), ErrorParse)
+	}
+
+	var data SystemDLogLineRecord
+	if fields[0] != "-" {
+		logTime, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, errors.Join(errors.New("invalid RFC 5424 timestamp"), ErrorParse, err)
+		}
+		data.LogTime = logTime.In(location)
+		data.ExactTime = true
+	} else {
+		data.LogTime = time.Now().In(location)
+	}
+	data.Month = data.LogTime.Month().String()[:3]
+	data.Day = data.LogTime.Day()
+	data.Hour = data.LogTime.Hour()
+	data.Minute = data.LogTime.Minute()
+	data.Sec = data.LogTime.Second()
+
+	data.Host = nilValueDef(fields[1])
+	data.Unit = nilValueDef(fields[2])
+	if fields[3] != "-" {
+		pid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("invalid RFC 5424 PROCID: %s", fields[3]), ErrorParse, err)
+		}
+		data.Pid = pid
+	}
+
+	msg, err := skipStructuredData(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	data.LogRecord = strings.TrimPrefix(msg, "\ufeff")
+
+	return &data, nil
+}
+
+func skipStructuredData(rest string) (string, error) {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(rest[1:], " "), nil
+	}
+
+	inValue := false
+	depth := 0
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case inValue && c == '\\':
+			i++
+		case c == '"':
+			inValue = !inValue
+		case !inValue && c == '[':
+			depth++
+		case !inValue && c == ']':
+			depth--
+			if depth == 0 && (i+1 == len(rest) || rest[i+1] == ' ') {
+				return strings.TrimPrefix(rest[i+1:], " "), nil
+			}
+		}
+	}
+	return "", errors.Join(errors.New("invalid RFC 5424 structured data"), ErrorParse)
+}
+
+func nilValueDef(val string) string {
+	if val == "-" {
+		return ""
+	}
+	return val
+}
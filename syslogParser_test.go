@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	logRecord := "PROXY   : 2024/06/18 00:07:26 handler.go:138: INFO     Request: 143.178.228.182:64154 => 2.56.204.64:443 \"andre487\" HTTP/1.1 GET http://ifconfig.co/"
+
+	rec, err := ParseSyslogMessage("<30>Jun 18 00:07:26 p487-2-am dumbproxy[82403]: "+logRecord+"\n", time.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, &SystemDLogLineRecord{
+		Month:     "Jun",
+		Day:       18,
+		Hour:      0,
+		Minute:    7,
+		Sec:       26,
+		LogTime:   shortLogTimeOf(time.June, 18, 0, 7, 26),
+		Host:      "p487-2-am",
+		Unit:      "dumbproxy",
+		Pid:       82403,
+		LogRecord: logRecord,
+	}, rec)
+
+	rec, err = ParseSyslogMessage("<30>Jun  8 00:07:26 p487-2-am dumbproxy: FOO", time.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, rec.Day)
+	assert.Equal(t, 0, rec.Pid)
+	assert.Equal(t, "FOO", rec.LogRecord)
+
+	logTime := time.Date(2024, time.June, 18, 0, 7, 26, 123456000, time.UTC).Local()
+	rec, err = ParseSyslogMessage("<30>1 2024-06-18T00:07:26.123456Z p487-2-am dumbproxy 82403 - [meta sequenceId=\"1\" note=\"a \\\"]\\\" b\"][x y=\"z\"] \ufeff"+logRecord, time.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, &SystemDLogLineRecord{
+		Month:     logTime.Month().String()[:3],
+		Day:       logTime.Day(),
+		Hour:      logTime.Hour(),
+		Minute:    logTime.Minute(),
+		Sec:       logTime.Second(),
+		LogTime:   logTime,
+		Host:      "p487-2-am",
+		Unit:      "dumbproxy",
+		Pid:       82403,
+		LogRecord: logRecord,
+		ExactTime: true,
+	}, rec)
+
+	rec, err = ParseSyslogMessage("<30>1 2024-06-18T03:07:26+03:00 - dumbproxy - ID47 - FOO", time.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, logTime.Truncate(time.Second), rec.LogTime)
+	assert.Equal(t, "", rec.Host)
+	assert.Equal(t, "FOO", rec.LogRecord)
+
+	res, err := ParseLogLineOfFormat("<30>1 2024-06-18T00:07:26.123456Z p487-2-am dumbproxy 82403 - - "+logRecord, LogFormatSyslogMessage)
+	assert.NoError(t, err)
+	assert.Equal(t, LogLineTypeProxyRequest, res.LogLineType)
+	assert.Equal(t, logTime.UTC(), res.LogTime)
+	assert.Equal(t, "p487-2-am", res.Host)
+
+	_, err = ParseSyslogMessage("Jun 18 00:07:26 p487-2-am dumbproxy[82403]: FOO", time.Local)
+	assert.ErrorIs(t, err, ErrorParse)
+	_, err = ParseSyslogMessage("<30>1 2024-06-18T00:07:26Z host", time.Local)
+	assert.ErrorIs(t, err, ErrorParse)
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("11 <30>1 - - -7 <30>FOO<30>BAR\n<30>BAZ"))
+	assert.Equal(t, "<30>1 - - -", Must1(readSyslogFrame(reader)))
+	assert.Equal(t, "<30>FOO", Must1(readSyslogFrame(reader)))
+	assert.Equal(t, "<30>BAR\n", Must1(readSyslogFrame(reader)))
+	assert.Equal(t, "<30>BAZ", Must1(readSyslogFrame(reader)))
+	_, err := readSyslogFrame(reader)
+	assert.Error(t, err)
+}
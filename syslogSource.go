@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+const syslogMaxMessageSize = 64 * 1024
+
+type SyslogLogSourceParams struct {
+	// Proto is one of udp, tcp or both
+	Proto      string
+	ListenAddr string
+}
+
+// SyslogLogSource receives RFC 3164 and RFC 5424 messages over UDP and TCP
+type SyslogLogSource struct {
+	SyslogLogSourceParams
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	lines       chan string
+	done        chan struct{}
+	startOnce   sync.Once
+	closeOnce   sync.Once
+}
+
+func NewSyslogLogSource(params SyslogLogSourceParams) (*SyslogLogSource, error) {
+	if params.ListenAddr == "" {
+		return nil, errors.New("listen address is required for SyslogLogSource")
+	}
+	if params.Proto == "" {
+		params.Proto = "both"
+	}
+	if params.Proto != "udp" && params.Proto != "tcp" && params.Proto != "both" {
+		return nil, fmt.Errorf("invalid syslog protocol: %s", params.Proto)
+	}
+
+	return &SyslogLogSource{
+		SyslogLogSourceParams: params,
+		lines:                 make(chan string, 128),
+		done:                  make(chan struct{}),
+	}, nil
+}
+
+// Open starts listeners on the first call, the next calls are no-op
+func (t *SyslogLogSource) Open() error {
+	var err error
+	t.startOnce.Do(func() {
+		err = t.listen()
+	})
+	return err
+}
+
+func (t *SyslogLogSource) ReadLine() (*LogSourceLine, error) {
+	select {
+	case line := <-t.lines:
+		return &LogSourceLine{Text: line, Format: LogFormatSyslogMessage}, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *SyslogLogSource) Close() error {
+	var resErr error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.udpConn != nil {
+			if err := t.udpConn.Close(); err != nil {
+				resErr = multierror.Append(resErr, err)
+			}
+		}
+		if t.tcpListener != nil {
+			if err := t.tcpListener.Close(); err != nil {
+				resErr = multierror.Append(resErr, err)
+			}
+		}
+	})
+	return resErr
+}
+
+func (t *SyslogLogSource) listen() error {
+	if t.Proto == "udp" || t.Proto == "both" {
+		conn, err := net.ListenPacket("udp", t.ListenAddr)
+		if err != nil {
+			return errors.Join(fmt.Errorf("unable to listen syslog UDP on %s", t.ListenAddr), err)
+		}
+		t.udpConn = conn
+		log.Infof("Listening syslog on udp %s", conn.LocalAddr())
+		go t.serveUdp()
+	}
+
+	if t.Proto == "tcp" || t.Proto == "both" {
+		listener, err := net.Listen("tcp", t.ListenAddr)
+		if err != nil {
+			return errors.Join(fmt.Errorf("unable to listen syslog TCP on %s", t.ListenAddr), err)
+		}
+		t.tcpListener = listener
+		log.Infof("Listening syslog on tcp %s", listener.Addr())
+		go t.serveTcp()
+	}
+
+	return nil
+}
+
+func (t *SyslogLogSource) serveUdp() {
+	buf := make([]byte, syslogMaxMessageSize)
+	for {
+		n, _, err := t.udpConn.ReadFrom(buf)
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			log.Warnf("Syslog UDP read error: %s", err)
+			continue
+		}
+		t.pushLine(string(buf[:n]))
+	}
+}
+
+func (t *SyslogLogSource) serveTcp() {
+	for {
+		conn, err := t.tcpListener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			log.Warnf("Syslog TCP accept error: %s", err)
+			continue
+		}
+		go t.handleTcpConn(conn)
+	}
+}
+
+// handleTcpConn reads messages framed with octet counting or with newlines (RFC 6587)
+func (t *SyslogLogSource) handleTcpConn(conn net.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-t.done:
+		case <-finished:
+		}
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, syslogMaxMessageSize)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !t.isClosed() {
+				log.Warnf("Syslog TCP read error from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		t.pushLine(msg)
+	}
+}
+
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		lenStr, err := reader.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		msgLen, err := strconv.Atoi(strings.TrimSpace(lenStr))
+		if err != nil || msgLen <= 0 || msgLen > syslogMaxMessageSize {
+			return "", fmt.Errorf("invalid syslog frame length: %q", lenStr)
+		}
+
+		buf := make([]byte, msgLen)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return line, nil
+}
+
+func (t *SyslogLogSource) pushLine(line string) {
+	line = strings.TrimRight(line, "\r\n\x00")
+	if line == "" {
+		return
+	}
+
+	select {
+	case t.lines <- line:
+	case <-t.done:
+	}
+}
+
+func (t *SyslogLogSource) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
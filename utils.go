@@ -2,6 +2,8 @@ package main
 
 import (
 	"io"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,6 +15,25 @@ func StrDef(val string, def string) string {
 	return val
 }
 
+// splitList splits a comma separated list skipping empty items
+func splitList(val string) []string {
+	var res []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// LoadLocation loads a timezone like Europe/Amsterdam, empty and Local mean the system timezone
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
 func Must0(err error) {
 	if err != nil {
 		log.Fatalf("ERROR Unexpected error: %s", err)